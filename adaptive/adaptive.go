@@ -0,0 +1,182 @@
+// Package adaptive limits the requests in flight to an upstream with a limit that follows
+// its latency: the limit grows while the latency stays near the lowest one seen and shrinks
+// as the latency rises with the load, or when requests fail.
+package adaptive
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Options tune a Limiter, their zero values are replaced by defaults
+type Options struct {
+	InitialLimit int // defaults to 20
+	MinLimit     int // defaults to 5
+	MaxLimit     int // defaults to 1000
+	// Tolerance is the latency increase over the lowest latency taken as normal, 1.5 lets
+	// the latency rise by half before the limit shrinks. Defaults to 1.5.
+	Tolerance float64
+	// Smoothing is the weight of each new limit against the current one, defaults to 0.2
+	Smoothing float64
+	// Backoff multiplies the limit when requests fail, defaults to 0.9
+	Backoff float64
+	// MinRTTResetWindows is the number of windows after which the lowest latency is
+	// measured again, so a lasting change of the upstream is followed. Defaults to 100.
+	MinRTTResetWindows int
+}
+
+func (o *Options) defaults() {
+	if o.InitialLimit <= 0 {
+		o.InitialLimit = 20
+	}
+	if o.MinLimit <= 0 {
+		o.MinLimit = 5
+	}
+	if o.MaxLimit <= 0 {
+		o.MaxLimit = 1000
+	}
+	o.InitialLimit = min(max(o.InitialLimit, o.MinLimit), o.MaxLimit)
+	if o.Tolerance < 1 {
+		o.Tolerance = 1.5
+	}
+	if o.Smoothing <= 0 || o.Smoothing > 1 {
+		o.Smoothing = 0.2
+	}
+	if o.Backoff <= 0 || o.Backoff >= 1 {
+		o.Backoff = 0.9
+	}
+	if o.MinRTTResetWindows <= 0 {
+		o.MinRTTResetWindows = 100
+	}
+}
+
+// Outcome is how a request ended, as far as the limit is concerned
+type Outcome int
+
+const (
+	Success Outcome = iota
+	Failure         // the upstream failed or timed out, the limit backs off
+	Ignore          // the request says nothing of the upstream load, such as a stream
+)
+
+// Limiter is a gradient concurrency limiter. Once per window of about limit samples, the
+// new limit is limit × gradient + √limit, where the gradient is Tolerance × the lowest
+// latency / the window's average latency, between 0.5 and 1. The square root lets a small
+// queue build up so the limit can grow while the latency holds. Every MinRTTResetWindows
+// windows the limit is halved and the lowest latency measured again.
+type Limiter struct {
+	options Options
+
+	mutex       sync.Mutex
+	limit       float64
+	inFlight    int
+	maxInFlight int // highest in flight during the window, the limit only grows when it's used
+	shed        int64
+
+	minRTT      time.Duration
+	minRTTAge   int // windows since minRTT was reset
+	windowCount int
+	windowSum   time.Duration
+	windowFails int
+}
+
+// New returns a limiter starting at options.InitialLimit
+func New(options Options) *Limiter {
+	options.defaults()
+	return &Limiter{options: options, limit: float64(options.InitialLimit)}
+}
+
+// Acquire admits a request if there's room under the limit. done must then be called with
+// the request's latency, to its response headers, and outcome.
+func (l *Limiter) Acquire() (done func(latency time.Duration, outcome Outcome), ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight >= int(l.limit) {
+		l.shed++
+		return nil, false
+	}
+	l.inFlight++
+	l.maxInFlight = max(l.maxInFlight, l.inFlight)
+	var once sync.Once
+	return func(latency time.Duration, outcome Outcome) {
+		once.Do(func() { l.release(latency, outcome) })
+	}, true
+}
+
+func (l *Limiter) release(latency time.Duration, outcome Outcome) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight--
+
+	switch outcome {
+	case Ignore:
+		return
+	case Failure:
+		l.windowFails++
+	case Success:
+		if latency <= 0 {
+			return
+		}
+		if l.minRTT == 0 || latency < l.minRTT {
+			l.minRTT = latency
+		}
+		l.windowSum += latency
+	}
+	l.windowCount++
+	if l.windowCount >= max(int(l.limit)/2, 1) {
+		l.update()
+	}
+}
+
+// update computes the limit from the samples of the window and starts a new window
+func (l *Limiter) update() {
+	newLimit := l.limit
+	successes := l.windowCount - l.windowFails
+	switch {
+	case l.windowFails > 0 && l.windowFails*10 >= l.windowCount:
+		// 10% of failures or more, the upstream is overloaded
+		newLimit = l.limit * l.options.Backoff
+	case successes > 0:
+		avg := l.windowSum / time.Duration(successes)
+		gradient := math.Max(0.5, math.Min(1, l.options.Tolerance*float64(l.minRTT)/float64(avg)))
+		newLimit = l.limit*gradient + math.Sqrt(l.limit)
+		if newLimit > l.limit && l.maxInFlight < int(l.limit)/2 {
+			// The limit isn't used, growing it would be a guess
+			newLimit = l.limit
+		}
+		newLimit = l.limit*(1-l.options.Smoothing) + newLimit*l.options.Smoothing
+	}
+	l.windowCount, l.windowSum, l.windowFails = 0, 0, 0
+	l.maxInFlight = l.inFlight
+
+	l.minRTTAge++
+	if l.minRTTAge >= l.options.MinRTTResetWindows {
+		// Probes the lowest latency again, with half the load so it isn't measured overloaded.
+		// Cutting less than by the tolerance would let the limit creep up probe after probe.
+		l.minRTT, l.minRTTAge = 0, 0
+		newLimit /= 2
+	}
+	l.limit = math.Min(float64(l.options.MaxLimit), math.Max(float64(l.options.MinLimit), newLimit))
+}
+
+// Limit returns the current concurrency limit
+func (l *Limiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int(l.limit)
+}
+
+// InFlight returns the number of requests admitted and not done yet
+func (l *Limiter) InFlight() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inFlight
+}
+
+// Shed returns the number of requests refused since the limiter was created
+func (l *Limiter) Shed() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.shed
+}
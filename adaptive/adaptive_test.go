@@ -0,0 +1,108 @@
+package adaptive
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// origin simulates an upstream that answers in 10ms up to capacity requests in flight,
+// and slows down in proportion to the load beyond
+type origin struct {
+	capacity int
+}
+
+func (o origin) latency(inFlight int) time.Duration {
+	latency := 10 * time.Millisecond
+	if inFlight > o.capacity {
+		latency = latency * time.Duration(inFlight) / time.Duration(o.capacity)
+	}
+	return latency
+}
+
+// run sends demand concurrent requests per round to the origin for rounds rounds,
+// it returns the median limit of the last 100 rounds and the requests shed in the last one.
+// The median leaves out the dips of the limit while the lowest latency is probed.
+func run(l *Limiter, o origin, demand, rounds int) (limit, shed int) {
+	var limits []int
+	for round := 0; round < rounds; round++ {
+		var dones []func(time.Duration, Outcome)
+		shed = 0
+		for i := 0; i < demand; i++ {
+			if done, ok := l.Acquire(); ok {
+				dones = append(dones, done)
+			} else {
+				shed++
+			}
+		}
+		latency := o.latency(len(dones))
+		for _, done := range dones {
+			done(latency, Success)
+		}
+		limits = append(limits, l.Limit())
+	}
+	limits = limits[max(0, len(limits)-100):]
+	slices.Sort(limits)
+	return limits[len(limits)/2], shed
+}
+
+func TestLimiter_converges(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		demand   int
+		wantMin  int
+		wantMax  int
+	}{
+		{name: "overloaded small origin", capacity: 20, demand: 200, wantMin: 20, wantMax: 40},
+		{name: "overloaded large origin", capacity: 100, demand: 500, wantMin: 100, wantMax: 170},
+		{name: "light load", capacity: 100, demand: 10, wantMin: 5, wantMax: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(Options{})
+			limit, shed := run(l, origin{capacity: tt.capacity}, tt.demand, 500)
+			assert.GreaterOrEqual(t, limit, tt.wantMin)
+			assert.LessOrEqual(t, limit, tt.wantMax)
+			assert.Equal(t, tt.demand > tt.wantMax, shed > 0, "the excess is shed")
+			assert.Zero(t, l.InFlight())
+		})
+	}
+}
+
+func TestLimiter_followsOrigin(t *testing.T) {
+	l := New(Options{})
+	high, _ := run(l, origin{capacity: 100}, 500, 500)
+
+	// The origin loses capacity, the limit follows it down
+	low, _ := run(l, origin{capacity: 25}, 500, 500)
+	assert.Less(t, low, high/2)
+	assert.GreaterOrEqual(t, low, 25)
+}
+
+func TestLimiter_failures(t *testing.T) {
+	l := New(Options{InitialLimit: 100})
+	for i := 0; i < 20; i++ {
+		var dones []func(time.Duration, Outcome)
+		for {
+			done, ok := l.Acquire()
+			if !ok {
+				break
+			}
+			dones = append(dones, done)
+		}
+		for _, done := range dones {
+			done(0, Failure)
+		}
+	}
+	assert.Equal(t, 5, l.Limit(), "failures back the limit off to its minimum")
+	assert.Positive(t, l.Shed())
+
+	done, ok := l.Acquire()
+	assert.True(t, ok)
+	done(time.Millisecond, Ignore)
+	done(time.Millisecond, Ignore)
+	assert.Zero(t, l.InFlight(), "done is idempotent")
+}
@@ -0,0 +1,127 @@
+// Package auth authenticates requests with API keys, Basic auth or JWTs and forwards
+// the authenticated identity upstream.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"proxy/errpage"
+	"proxy/utils"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request has none of its credentials
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned by an Authenticator when the credentials are wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is who a request was authenticated as
+type Identity struct {
+	Subject string
+	Method  string         // api_key, basic or jwt
+	Claims  map[string]any // JWT claims
+}
+
+// Authenticator finds and checks one kind of credentials
+type Authenticator interface {
+	// Authenticate returns the identity of the request, ErrNoCredentials when the request
+	// has no credentials of this kind, or an error wrapping ErrInvalidCredentials.
+	Authenticate(r *http.Request) (*Identity, error)
+	// Challenge is the WWW-Authenticate header value sent with 401 responses, or empty
+	Challenge() string
+}
+
+// Headers forwarding the identity upstream, those sent by clients are removed
+const (
+	SubjectHeader = "X-Auth-Subject"
+	MethodHeader  = "X-Auth-Method"
+)
+
+// Policy is the authentication of a route
+type Policy struct {
+	// Authenticators are tried in order, the first one finding its credentials decides
+	Authenticators []Authenticator
+	// Optional lets requests without credentials through, unauthenticated
+	Optional bool
+	// ClaimHeaders forwards JWT claims upstream, from claim name to header name
+	ClaimHeaders map[string]string
+}
+
+type identityContextKey struct{}
+
+// FromContext returns the identity of the request, nil if it wasn't authenticated
+func FromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return identity
+}
+
+// Key returns the key rate limiting the request, its subject when it's authenticated
+// and its client IP otherwise
+func Key(r *http.Request) string {
+	if identity := FromContext(r.Context()); identity != nil {
+		return identity.Method + ":" + identity.Subject
+	}
+	return utils.GetRemoteIP(r)
+}
+
+// Handler authenticates the requests before they're handled by h, the requests that
+// fail are answered with 401
+func Handler(h http.Handler, policy Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(SubjectHeader)
+		r.Header.Del(MethodHeader)
+		for _, header := range policy.ClaimHeaders {
+			r.Header.Del(header)
+		}
+
+		identity, err := authenticate(r, policy.Authenticators)
+		switch {
+		case err == nil:
+			r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity))
+			forward(r.Header, identity, policy.ClaimHeaders)
+		case errors.Is(err, ErrNoCredentials) && policy.Optional:
+		default:
+			for _, a := range policy.Authenticators {
+				if challenge := a.Challenge(); challenge != "" {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			errpage.Write(w, r, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func authenticate(r *http.Request, authenticators []Authenticator) (*Identity, error) {
+	for _, a := range authenticators {
+		identity, err := a.Authenticate(r)
+		if !errors.Is(err, ErrNoCredentials) {
+			return identity, err
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+func forward(header http.Header, identity *Identity, claimHeaders map[string]string) {
+	header.Set(SubjectHeader, identity.Subject)
+	header.Set(MethodHeader, identity.Method)
+	for claim, name := range claimHeaders {
+		switch v := identity.Claims[claim].(type) {
+		case string:
+			header.Set(name, v)
+		case []any:
+			var values []string
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					values = append(values, s)
+				}
+			}
+			header.Set(name, strings.Join(values, ","))
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0o600))
+	basic, err := LoadHtpasswd(htpasswd, "api")
+	assert.NoError(t, err)
+	apiKeys := NewAPIKeys("X-API-Key", "api_key", map[string]string{"k1": "service-a"})
+
+	tests := []struct {
+		name        string
+		optional    bool
+		prepare     func(r *http.Request)
+		wantStatus  int
+		wantSubject string
+		wantMethod  string
+		wantKey     string
+		wantQuery   string
+	}{
+		{
+			name:        "api key header",
+			prepare:     func(r *http.Request) { r.Header.Set("X-API-Key", "k1") },
+			wantStatus:  http.StatusOK,
+			wantSubject: "service-a",
+			wantMethod:  "api_key",
+			wantKey:     "api_key:service-a",
+		},
+		{
+			name:        "api key query",
+			prepare:     func(r *http.Request) { r.URL.RawQuery = "api_key=k1&page=2" },
+			wantStatus:  http.StatusOK,
+			wantSubject: "service-a",
+			wantMethod:  "api_key",
+			wantQuery:   "page=2",
+		},
+		{
+			name:       "wrong api key",
+			prepare:    func(r *http.Request) { r.Header.Set("X-API-Key", "k2") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:        "basic",
+			prepare:     func(r *http.Request) { r.SetBasicAuth("alice", "secret") },
+			wantStatus:  http.StatusOK,
+			wantSubject: "alice",
+			wantMethod:  "basic",
+		},
+		{
+			name:       "wrong password",
+			prepare:    func(r *http.Request) { r.SetBasicAuth("alice", "guess") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown user",
+			prepare:    func(r *http.Request) { r.SetBasicAuth("bob", "secret") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			// Unknown users are checked against the dummy hash, which must not let them in
+			name:       "unknown user, dummy password",
+			prepare:    func(r *http.Request) { r.SetBasicAuth("bob", "dummy") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no credentials",
+			prepare:    func(r *http.Request) { r.Header.Set(SubjectHeader, "spoofed") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no credentials optional",
+			optional:   true,
+			prepare:    func(r *http.Request) { r.Header.Set(SubjectHeader, "spoofed") },
+			wantStatus: http.StatusOK,
+			wantKey:    "192.0.2.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream *http.Request
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r
+			}), Policy{Authenticators: []Authenticator{apiKeys, basic}, Optional: tt.optional})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.prepare(r)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.Equal(t, `Basic realm="api"`, w.Header().Get("WWW-Authenticate"))
+				return
+			}
+			assert.Equal(t, tt.wantSubject, upstream.Header.Get(SubjectHeader))
+			assert.Equal(t, tt.wantMethod, upstream.Header.Get(MethodHeader))
+			assert.Empty(t, upstream.Header.Get("X-API-Key"), "credentials aren't forwarded")
+			assert.Empty(t, upstream.Header.Get("Authorization"), "credentials aren't forwarded")
+			if tt.wantKey != "" {
+				assert.Equal(t, tt.wantKey, Key(upstream))
+			}
+			if tt.wantQuery != "" {
+				assert.Equal(t, tt.wantQuery, upstream.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns a JWT of claims signed by key with alg
+func sign(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(signature)
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "k": b64(secret)},
+		{"kty": "RSA", "kid": "rs", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "es", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()), "use": "sig"},
+		{"kty": "EC", "crv": "P-256", "x": b64(otherKey.X.Bytes()), "y": b64(otherKey.Y.Bytes()), "use": "enc"},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, jwks, 0o644))
+
+	now := time.Unix(1700000000, 0)
+	j, err := LoadJWT(path, "proxy", 30*time.Second)
+	assert.NoError(t, err)
+	j.now = func() time.Time { return now }
+
+	valid := map[string]any{"sub": "alice", "aud": []string{"other", "proxy"}, "exp": now.Unix() + 60, "nbf": now.Unix() - 60}
+	with := func(key string, value any) map[string]any {
+		claims := map[string]any{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "HS256", token: sign(t, "HS256", "hs", secret, valid)},
+		{name: "RS256", token: sign(t, "RS256", "rs", rsaKey, valid)},
+		{name: "ES256", token: sign(t, "ES256", "es", ecKey, valid)},
+		{name: "no kid", token: sign(t, "ES256", "", ecKey, valid)},
+		{name: "wrong kid", token: sign(t, "ES256", "rs", ecKey, valid), wantErr: true},
+		{name: "encryption key", token: sign(t, "ES256", "", otherKey, valid), wantErr: true},
+		{name: "unknown key", token: sign(t, "HS256", "hs", []byte("guess"), valid), wantErr: true},
+		{name: "public key as HMAC secret", token: sign(t, "HS256", "rs", rsaKey.N.Bytes(), valid), wantErr: true},
+		{name: "none", token: b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"alice"}`)) + ".", wantErr: true},
+		{name: "expired", token: sign(t, "HS256", "hs", secret, with("exp", now.Unix()-31)), wantErr: true},
+		{name: "expired within leeway", token: sign(t, "HS256", "hs", secret, with("exp", now.Unix()-10))},
+		{name: "not valid yet", token: sign(t, "HS256", "hs", secret, with("nbf", now.Unix()+31)), wantErr: true},
+		{name: "wrong audience", token: sign(t, "HS256", "hs", secret, with("aud", "other")), wantErr: true},
+		{name: "single audience", token: sign(t, "HS256", "hs", secret, with("aud", "proxy"))},
+		{name: "no subject", token: sign(t, "HS256", "hs", secret, with("sub", "")), wantErr: true},
+		{name: "malformed", token: "a.b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			identity, err := j.Authenticate(r)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidCredentials)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, "alice", identity.Subject)
+				assert.Equal(t, "jwt", identity.Method)
+			}
+		})
+	}
+}
+
+func TestHandler_claimHeaders(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	j := &JWT{keys: []verificationKey{{alg: "HS256", key: secret}}, now: time.Now}
+	var upstream *http.Request
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+	}), Policy{Authenticators: []Authenticator{j}, ClaimHeaders: map[string]string{"scope": "X-Auth-Scope", "groups": "X-Auth-Groups"}})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Auth-Scope", "admin")
+	r.Header.Set("Authorization", "Bearer "+sign(t, "HS256", "", secret, map[string]any{"sub": "alice", "groups": []string{"a", "b"}}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", FromContext(upstream.Context()).Subject)
+	assert.Empty(t, upstream.Header.Get("X-Auth-Scope"), "spoofed claim headers are removed")
+	assert.Equal(t, "a,b", upstream.Header.Get("X-Auth-Groups"))
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+}
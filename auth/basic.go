@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Basic authenticates requests with Basic auth against users from an htpasswd file
+type Basic struct {
+	Realm  string
+	hashes map[string][]byte // bcrypt hash by user
+	// dummy is compared against for unknown users, so that they take as long to reject as
+	// wrong passwords and don't reveal which users exist
+	dummy []byte
+}
+
+// LoadHtpasswd reads an htpasswd file of user:hash lines, only bcrypt hashes are supported
+// (htpasswd -B)
+func LoadHtpasswd(path, realm string) (*Basic, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &Basic{Realm: realm, hashes: map[string][]byte{}}
+	dummyCost := bcrypt.MinCost
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, n)
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s has no bcrypt hash", path, n, user)
+		}
+		dummyCost = max(dummyCost, cost)
+		b.hashes[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// The dummy costs as much as the most expensive hash of the file
+	b.dummy, err = bcrypt.GenerateFromPassword([]byte("dummy"), dummyCost)
+	return b, err
+}
+
+func (b *Basic) Authenticate(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash, ok := b.hashes[user]
+	if !ok {
+		hash = b.dummy
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return nil, fmt.Errorf("%w: wrong user or password", ErrInvalidCredentials)
+	}
+	r.Header.Del("Authorization")
+	return &Identity{Subject: user, Method: "basic"}, nil
+}
+
+func (b *Basic) Challenge() string {
+	realm := b.Realm
+	if realm == "" {
+		realm = "proxy"
+	}
+	return fmt.Sprintf("Basic realm=%q", realm)
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// jwk is a key of a JSON Web Key Set (RFC 7517), RSA, EC P-256 and symmetric keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// verificationKey is a key of the set, with the only algorithm it verifies
+type verificationKey struct {
+	kid string
+	alg string // HS256, RS256 or ES256
+	key crypto.PublicKey
+}
+
+// loadJWKS reads the keys of a JWKS file, the keys not used for signatures are ignored
+func loadJWKS(path string) ([]verificationKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %w", path, err)
+	}
+
+	var keys []verificationKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.verificationKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS %s: key %d: %w", path, i, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signature keys in JWKS %s", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) verificationKey() (verificationKey, error) {
+	var key verificationKey
+	switch k.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return key, errors.New("invalid k")
+		}
+		key = verificationKey{alg: "HS256", key: secret}
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return key, errors.New("invalid n or e")
+		}
+		key = verificationKey{alg: "RS256", key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}}
+	case "EC":
+		if k.Crv != "P-256" {
+			return key, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return key, errors.New("invalid x or y")
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return key, errors.New("point not on the curve")
+		}
+		key = verificationKey{alg: "ES256", key: public}
+	default:
+		return key, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != key.alg {
+		return key, fmt.Errorf("unsupported algorithm %s for a %s key", k.Alg, k.Kty)
+	}
+	key.kid = k.Kid
+	return key, nil
+}
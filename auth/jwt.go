@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWT authenticates requests with a bearer JSON Web Token signed with HS256, RS256 or ES256.
+// The token is verified with the keys of a local JWKS file and its exp, nbf and aud claims
+// are checked. The subject is the sub claim, tokens without one are refused as they'd all
+// share the rate limiting key of an empty subject.
+type JWT struct {
+	Audience string        // required in the aud claim when set
+	Leeway   time.Duration // clock skew allowed on exp and nbf
+	keys     []verificationKey
+	now      func() time.Time
+}
+
+// LoadJWT returns a JWT authenticator verifying the tokens with the keys of the JWKS file
+func LoadJWT(jwksPath, audience string, leeway time.Duration) (*JWT, error) {
+	keys, err := loadJWKS(jwksPath)
+	if err != nil {
+		return nil, err
+	}
+	return &JWT{Audience: audience, Leeway: leeway, keys: keys, now: time.Now}, nil
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no sub claim", ErrInvalidCredentials)
+	}
+	// The token stays in the request, upstream servers may check it too
+	return &Identity{Subject: subject, Method: "jwt", Claims: claims}, nil
+}
+
+func (j *JWT) Challenge() string {
+	return "Bearer"
+}
+
+// verify checks the signature and the time and audience claims of token, it returns its claims
+func (j *JWT) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	// The algorithm must be the one of the key, so a public key can't be used as an HMAC secret
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range j.keys {
+		if key.alg == header.Alg && (header.Kid == "" || key.kid == header.Kid) && verifySignature(key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	claims := map[string]any{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	now := j.now()
+	if exp, ok := claims["exp"].(float64); ok && !now.Before(unixTime(exp).Add(j.Leeway)) {
+		return nil, fmt.Errorf("token expired")
+	} else if !ok && claims["exp"] != nil {
+		return nil, fmt.Errorf("invalid exp claim")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.Leeway).Before(unixTime(nbf)) {
+		return nil, fmt.Errorf("token not valid yet")
+	} else if !ok && claims["nbf"] != nil {
+		return nil, fmt.Errorf("invalid nbf claim")
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, fmt.Errorf("token not issued for %s", j.Audience)
+	}
+	return claims, nil
+}
+
+func verifySignature(key verificationKey, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch public := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, public)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS ECDSA signatures are the 32 bytes big-endian R and S concatenated
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, digest[:], r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// hasAudience tells whether the aud claim, a string or a list of strings, holds audience
+func hasAudience(aud any, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []any:
+		for _, e := range v {
+			if e == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
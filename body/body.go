@@ -0,0 +1,198 @@
+// Package body limits the size and the upload rate of request bodies, and optionally
+// buffers them, in memory or in a temporary file, so they can be sent more than once.
+package body
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"proxy/errpage"
+)
+
+// Causes of the request context cancellation, see context.Cause
+var (
+	ErrTooLarge = errors.New("request body too large")
+	ErrTooSlow  = errors.New("request body upload too slow")
+)
+
+// Policy holds the body settings of a route, zero values disable the corresponding check
+type Policy struct {
+	// MaxBytes is the largest body accepted, larger ones get a 413
+	MaxBytes int64
+	// Buffer reads the whole body before the request goes upstream. The request then
+	// has a GetBody function and its body can be replayed.
+	Buffer bool
+	// MemoryBytes is the part of a buffered body kept in memory, the rest goes to a temporary file
+	MemoryBytes int64
+	// TempDir is where buffered bodies spill, os.TempDir() when empty
+	TempDir string
+	// MinRate is the slowest upload accepted in bytes per second, checked once MinRateGrace has passed
+	MinRate      int64
+	MinRateGrace time.Duration
+}
+
+// Handler wraps h with the policy p
+func Handler(h http.Handler, p Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if p.MaxBytes > 0 && r.ContentLength > p.MaxBytes {
+			errpage.Write(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		r = r.WithContext(ctx)
+		cr := &checkedReader{ReadCloser: r.Body, policy: &p, cancel: cancel, start: time.Now()}
+		if p.MinRate > 0 {
+			rc := http.NewResponseController(w)
+			cr.rateTimer = time.AfterFunc(max(p.MinRateGrace, time.Second), func() { cr.checkRate(rc) })
+			defer cr.stopRateCheck()
+		}
+		r.Body = cr
+
+		if !p.Buffer {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		buffered, err := newBuffer(cr, &p)
+		if err != nil {
+			switch cause := context.Cause(ctx); {
+			case errors.Is(cause, ErrTooLarge):
+				errpage.Write(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			case errors.Is(cause, ErrTooSlow):
+				errpage.Write(w, r, http.StatusRequestTimeout, "Request body upload too slow")
+			default:
+				errpage.Write(w, r, http.StatusBadRequest, "Could not read request body")
+			}
+			return
+		}
+		defer buffered.remove()
+
+		r.ContentLength = buffered.size
+		r.Body, _ = buffered.open()
+		r.GetBody = buffered.open
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkedReader enforces the size limit and the minimum upload rate while the body is read
+type checkedReader struct {
+	io.ReadCloser
+	policy *Policy
+	cancel context.CancelCauseFunc
+	start  time.Time
+
+	mutex     sync.Mutex
+	read      int64
+	done      bool
+	rateTimer *time.Timer
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.read += int64(n)
+	if c.policy.MaxBytes > 0 && c.read > c.policy.MaxBytes {
+		c.cancel(ErrTooLarge)
+		return n, ErrTooLarge
+	}
+	if err != nil {
+		c.done = true
+	}
+	return n, err
+}
+
+// checkRate runs every second once the grace period is over, until the body is read
+func (c *checkedReader) checkRate(rc *http.ResponseController) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done {
+		return
+	}
+	elapsed := time.Since(c.start)
+	if rate := float64(c.read) / elapsed.Seconds(); rate < float64(c.policy.MinRate) {
+		log.Printf("body: upload at %.0fB/s under the %dB/s minimum, dropping it", rate, c.policy.MinRate)
+		c.done = true
+		c.cancel(ErrTooSlow)
+		// unblock the pending read
+		rc.SetReadDeadline(time.Now())
+		return
+	}
+	c.rateTimer.Reset(time.Second)
+}
+
+func (c *checkedReader) stopRateCheck() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.done = true
+	c.rateTimer.Stop()
+}
+
+// buffer is a whole request body held in memory, and in a temporary file past MemoryBytes
+type buffer struct {
+	memory []byte
+	file   *os.File
+	size   int64
+}
+
+func newBuffer(r io.Reader, p *Policy) (*buffer, error) {
+	b := &buffer{}
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(r, p.MemoryBytes))
+	b.memory, b.size = mem.Bytes(), n
+	if err != nil {
+		return nil, err
+	}
+	if n < p.MemoryBytes {
+		return b, nil
+	}
+
+	// the body may go on, spill the rest to disk
+	if b.file, err = os.CreateTemp(p.TempDir, "proxy-body-"); err != nil {
+		return nil, err
+	}
+	n, err = io.Copy(b.file, r)
+	b.size += n
+	if err != nil {
+		b.remove()
+		return nil, err
+	}
+	return b, nil
+}
+
+// open returns a new reader over the whole body
+func (b *buffer) open() (io.ReadCloser, error) {
+	if b.file == nil {
+		return io.NopCloser(bytes.NewReader(b.memory)), nil
+	}
+	f, err := os.Open(b.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b.memory), f), f}, nil
+}
+
+// remove deletes the temporary file. Readers opened before keep working until closed.
+func (b *buffer) remove() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
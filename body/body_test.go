@@ -0,0 +1,121 @@
+package body
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_MaxBytes(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     Policy
+		body       string
+		unknownLen bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "under_limit", policy: Policy{MaxBytes: 10}, body: "payload", wantStatus: http.StatusOK, wantBody: "payload"},
+		{name: "content_length_over_limit", policy: Policy{MaxBytes: 4}, body: "payload", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "buffered_under_limit", policy: Policy{MaxBytes: 10, Buffer: true, MemoryBytes: 4}, body: "payload", wantStatus: http.StatusOK, wantBody: "payload"},
+		{name: "buffered_over_limit", policy: Policy{MaxBytes: 4, Buffer: true, MemoryBytes: 2}, body: "payload", unknownLen: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			w.Write(b)
+		}), tt.policy)
+
+		r := httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(tt.body))
+		if tt.unknownLen {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tt.wantStatus, w.Code, tt.name)
+		if tt.wantBody != "" {
+			assert.Equal(t, tt.wantBody, w.Body.String(), tt.name)
+		}
+	}
+}
+
+func TestHandler_StreamedOverLimit(t *testing.T) {
+	var cause error
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		assert.ErrorIs(t, err, ErrTooLarge)
+		cause = context.Cause(r.Context())
+	}), Policy{MaxBytes: 4})
+
+	r := httptest.NewRequest(http.MethodPost, "/post", strings.NewReader("payload"))
+	r.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.ErrorIs(t, cause, ErrTooLarge)
+}
+
+func TestHandler_Replay(t *testing.T) {
+	dir := t.TempDir()
+	var first, second string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		first = string(b)
+		rc, err := r.GetBody()
+		assert.NoError(t, err)
+		b, _ = io.ReadAll(rc)
+		rc.Close()
+		second = string(b)
+		assert.Equal(t, int64(len(first)), r.ContentLength)
+	}), Policy{Buffer: true, MemoryBytes: 3, TempDir: dir})
+
+	r := httptest.NewRequest(http.MethodPost, "/post", strings.NewReader("spilled payload"))
+	r.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "spilled payload", first)
+	assert.Equal(t, "spilled payload", second)
+
+	// the temporary file is removed once the request is served
+	files, _ := listDir(dir)
+	assert.Empty(t, files)
+}
+
+func listDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, err
+}
+
+func TestHandler_MinRate(t *testing.T) {
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	}), Policy{Buffer: true, MemoryBytes: 1024, MinRate: 100, MinRateGrace: time.Second}))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		// a few bytes then a stall, far under 100B/s
+		pw.Write([]byte("slow"))
+	}()
+
+	start := time.Now()
+	resp, err := http.Post(srv.URL, "text/plain", pr)
+	if err == nil {
+		assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
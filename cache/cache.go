@@ -0,0 +1,393 @@
+// Package cache implements an RFC 9111 shared HTTP cache as an http.Handler middleware.
+//
+// Responses are kept in an in-memory LRU bounded by a byte budget, optionally backed by a
+// disk tier. Freshness follows Cache-Control, Expires and Age, stale responses carrying
+// an ETag or Last-Modified are revalidated with a conditional request, Vary selects between
+// variants and concurrent misses for the same URL are collapsed into one upstream request.
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// statusHeader is set on every response going through the cache: HIT, MISS or REVALIDATED
+	statusHeader = "X-Cache"
+	// variantSep separates the URL from the Vary request header values in a variant key
+	variantSep = "\x00"
+	// partitionSep starts the partition of a key, it can't appear in header values
+	partitionSep = "\x01"
+)
+
+// Options configures a Cache
+type Options struct {
+	MaxBytes       int64  // byte budget of the in-memory tier
+	MaxObjectBytes int64  // bigger responses are not stored, defaults to an eighth of MaxBytes
+	Dir            string // directory of the disk tier, no disk tier when empty
+	MaxDiskBytes   int64  // byte budget of the disk tier
+	// Partition, when set, keeps the responses of requests it maps to different values
+	// apart, as if they varied on it. An empty partition is the one of unpartitioned URLs.
+	Partition func(r *http.Request) string
+}
+
+type Cache struct {
+	memory         store
+	disk           store
+	maxObjectBytes int64
+	flight         flight
+	partition      func(r *http.Request) string
+	now            func() time.Time
+}
+
+// NewCache creates a cache with an in-memory tier and, when opts.Dir is set, a disk tier
+// which is reloaded from the directory content.
+func NewCache(opts Options) (*Cache, error) {
+	c := &Cache{
+		memory:         newMemoryStore(opts.MaxBytes),
+		maxObjectBytes: opts.MaxObjectBytes,
+		partition:      opts.Partition,
+		now:            time.Now,
+	}
+	if c.maxObjectBytes <= 0 {
+		c.maxObjectBytes = opts.MaxBytes / 8
+	}
+	if opts.Dir != "" {
+		disk, err := newDiskStore(opts.Dir, opts.MaxDiskBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// Handler wraps h, the handler talking to the origins, with the cache
+func (c *Cache) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			c.serveUnsafe(w, r, h)
+			return
+		}
+		reqCC := parseCacheControl(r.Header)
+		if reqCC.has("no-store") || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" ||
+			strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := requestKey(r.URL, r.Host)
+		if c.partition != nil {
+			if p := c.partition(r); p != "" {
+				// Under the URL key like variants, so purging the URL removes the partitions too
+				key += variantSep + partitionSep + p
+			}
+		}
+		if e, ok := c.lookup(key, r); ok {
+			if c.fresh(e, reqCC) {
+				c.serve(w, r, e, "HIT")
+				return
+			}
+			if e.hasValidators() {
+				c.revalidate(w, r, h, key, e)
+				return
+			}
+		}
+
+		w.Header().Set(statusHeader, "MISS")
+		if r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if c.flight.do(key, func(release func()) { c.fetch(w, r, h, key, release) }) {
+			return
+		}
+		// another request fetched the same URL meanwhile, its response is stored unless
+		// it wasn't cacheable or this request selects another variant
+		if e, ok := c.lookup(key, r); ok && c.fresh(e, reqCC) {
+			c.serve(w, r, e, "HIT")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Purge removes the stored responses of a URL, all its variants included,
+// and returns how many entries were removed.
+func (c *Cache) Purge(u *url.URL) int {
+	key := requestKey(u, u.Host)
+	return c.purge(func(k string) bool {
+		return k == key || strings.HasPrefix(k, key+variantSep)
+	})
+}
+
+// PurgePrefix removes the stored responses of every URL starting with prefix.
+// Keys are the request host followed by the request URI, e.g. "127.0.0.1:9090/get".
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.purge(func(k string) bool {
+		return strings.HasPrefix(k, prefix)
+	})
+}
+
+func (c *Cache) purge(match func(key string) bool) int {
+	removed := c.memory.purge(match)
+	if c.disk != nil {
+		// the disk tier is written through so it holds at least what's in memory
+		removed = max(removed, c.disk.purge(match))
+	}
+	return removed
+}
+
+// fresh tells whether e can be served without contacting the origin (RFC 9111 section 4.2)
+func (c *Cache) fresh(e *entry, reqCC cacheControl) bool {
+	respCC := parseCacheControl(e.Header)
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false
+	}
+	age, lifetime := e.age(c.now()), e.freshnessLifetime()
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	if age < lifetime {
+		return true
+	}
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage") {
+		return false
+	}
+	if maxStale, ok := reqCC["max-stale"]; ok {
+		if maxStale == "" {
+			return true
+		}
+		if d, ok := reqCC.seconds("max-stale"); ok && age-lifetime <= d {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch forwards a miss upstream, streaming the response to the client and storing it when allowed.
+// The requests waiting for the same key are released as soon as the response header shows
+// the response can't be stored, so a long stream doesn't hold them.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, h http.Handler, key string, release func()) {
+	// the cache wants the full representation, not a 304 to the client's own validators
+	outreq := r.Clone(r.Context())
+	removeConditionals(outreq.Header)
+
+	tee := &teeWriter{ResponseWriter: w, maxBytes: c.maxObjectBytes, onHeader: func(status int, header http.Header) {
+		if !storable(r, status, header) {
+			release()
+		}
+	}}
+	requestTime := c.now()
+	h.ServeHTTP(tee, outreq)
+	if tee.status == 0 {
+		tee.WriteHeader(http.StatusOK)
+	}
+
+	if tee.truncated || !completeBody(tee.header, tee.body.Len()) || !storable(r, tee.status, tee.header) {
+		return
+	}
+	tee.header.Del(statusHeader)
+	c.store(key, r, &entry{
+		Status:       tee.status,
+		Header:       tee.header,
+		Body:         tee.body.Bytes(),
+		RequestTime:  requestTime,
+		ResponseTime: c.now(),
+	})
+}
+
+// revalidate asks the origin whether the stale entry e is still valid, using its validators
+func (c *Cache) revalidate(w http.ResponseWriter, r *http.Request, h http.Handler, key string, e *entry) {
+	outreq := r.Clone(r.Context())
+	removeConditionals(outreq.Header)
+	if etag := e.Header.Get("ETag"); etag != "" {
+		outreq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		outreq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	rec := newRecorder(w, c.maxObjectBytes)
+	requestTime := c.now()
+	h.ServeHTTP(rec, outreq)
+	responseTime := c.now()
+	if rec.streamed {
+		return
+	}
+
+	if rec.status == http.StatusNotModified {
+		// RFC 9111 section 4.3.4: freshen the stored response with the 304 header fields
+		updated := *e
+		updated.Header = e.Header.Clone()
+		for k, vs := range rec.header {
+			if k != "Content-Length" {
+				updated.Header[k] = vs
+			}
+		}
+		updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+		c.set(&updated)
+		c.serve(w, r, &updated, "REVALIDATED")
+		return
+	}
+
+	for k, vs := range rec.header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set(statusHeader, "MISS")
+	w.WriteHeader(rec.status)
+	if r.Method != http.MethodHead {
+		w.Write(rec.body.Bytes())
+	}
+
+	if r.Method == http.MethodGet &&
+		completeBody(rec.header, rec.body.Len()) && storable(r, rec.status, rec.header) {
+		c.store(key, r, &entry{
+			Status:       rec.status,
+			Header:       rec.header,
+			Body:         rec.body.Bytes(),
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+		})
+	}
+}
+
+// serveUnsafe passes requests with unsafe methods through and invalidates the stored
+// responses of their URL when they succeed (RFC 9111 section 4.4)
+func (c *Cache) serveUnsafe(w http.ResponseWriter, r *http.Request, h http.Handler) {
+	sw := &statusWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, r)
+	if sw.status >= 200 && sw.status < 400 {
+		u := *r.URL
+		u.Host = r.Host
+		c.Purge(&u)
+	}
+}
+
+// serve writes the stored response e to the client
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *entry, status string) {
+	header := w.Header()
+	for k, vs := range e.Header {
+		header[k] = append([]string(nil), vs...)
+	}
+	header.Set("Age", strconv.FormatInt(int64(e.age(c.now())/time.Second), 10))
+	header.Set(statusHeader, status)
+
+	if e.Status == http.StatusOK && notModified(r, e) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// store saves e for the request r. When the response varies, a marker entry listing the
+// Vary header fields is kept under key and e under the key of its variant.
+func (c *Cache) store(key string, r *http.Request, e *entry) {
+	e.Key = key
+	if vary := varyFields(e.Header); len(vary) > 0 {
+		c.set(&entry{Key: key, Vary: vary, Header: http.Header{}, ResponseTime: e.ResponseTime})
+		e.Key = variantKey(key, vary, r)
+	}
+	c.set(e)
+}
+
+// lookup returns the entry matching r, following the Vary marker when there's one
+func (c *Cache) lookup(key string, r *http.Request) (*entry, bool) {
+	e, ok := c.get(key)
+	if ok && len(e.Vary) > 0 {
+		return c.get(variantKey(key, e.Vary, r))
+	}
+	return e, ok
+}
+
+func (c *Cache) get(key string) (*entry, bool) {
+	if e, ok := c.memory.get(key); ok {
+		return e, true
+	}
+	if c.disk == nil {
+		return nil, false
+	}
+	e, ok := c.disk.get(key)
+	if ok {
+		c.memory.set(e)
+	}
+	return e, ok
+}
+
+func (c *Cache) set(e *entry) {
+	c.memory.set(e)
+	if c.disk != nil {
+		c.disk.set(e)
+	}
+}
+
+func requestKey(u *url.URL, host string) string {
+	return host + u.RequestURI()
+}
+
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, field := range vary {
+		b.WriteString(variantSep)
+		b.WriteString(strings.Join(r.Header.Values(field), ","))
+	}
+	return b.String()
+}
+
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, line := range h.Values("Vary") {
+		for _, field := range strings.Split(line, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+func removeConditionals(h http.Header) {
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		h.Del(k)
+	}
+}
+
+// completeBody checks the recorded body against the announced Content-Length
+func completeBody(h http.Header, n int) bool {
+	cl := h.Get("Content-Length")
+	return cl == "" || cl == strconv.Itoa(n)
+}
+
+// notModified evaluates the client's own validators against the stored response (RFC 9110 section 13.2.2)
+func notModified(r *http.Request, e *entry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Add(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func newTestCache(t *testing.T, opts Options) (*Cache, *fakeClock) {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = 1 << 20
+	}
+	c, err := NewCache(opts)
+	assert.NoError(t, err)
+	clock := &fakeClock{now: time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)}
+	c.now = clock.Now
+	return c, clock
+}
+
+func get(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCache_Freshness(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		elapsed      time.Duration
+		wantCache    string
+		wantUpstream int64
+	}{
+		{name: "fresh_max_age", cacheControl: "max-age=60", elapsed: 30 * time.Second, wantCache: "HIT", wantUpstream: 1},
+		{name: "stale_max_age", cacheControl: "max-age=60", elapsed: 61 * time.Second, wantCache: "MISS", wantUpstream: 2},
+		{name: "s_maxage_wins", cacheControl: "max-age=600, s-maxage=10", elapsed: 11 * time.Second, wantCache: "MISS", wantUpstream: 2},
+		{name: "no_store", cacheControl: "no-store", elapsed: 0, wantCache: "MISS", wantUpstream: 2},
+		{name: "private", cacheControl: "private, max-age=60", elapsed: 0, wantCache: "MISS", wantUpstream: 2},
+	}
+	for _, tt := range tests {
+		c, clock := newTestCache(t, Options{})
+		var upstream int64
+		h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&upstream, 1)
+			w.Header().Set("Cache-Control", tt.cacheControl)
+			w.Header().Set("Date", clock.Now().Format(http.TimeFormat))
+			w.Write([]byte("body"))
+		}))
+
+		assert.Equal(t, "MISS", get(h, "/get", nil).Header().Get(statusHeader), tt.name)
+		clock.Add(tt.elapsed)
+		w := get(h, "/get", nil)
+		assert.Equal(t, tt.wantCache, w.Header().Get(statusHeader), tt.name)
+		assert.Equal(t, "body", w.Body.String(), tt.name)
+		assert.Equal(t, tt.wantUpstream, upstream, tt.name)
+	}
+}
+
+func TestCache_Expires(t *testing.T) {
+	c, clock := newTestCache(t, Options{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", clock.Now().Format(http.TimeFormat))
+		w.Header().Set("Expires", clock.Now().Add(time.Minute).Format(http.TimeFormat))
+		w.Write([]byte("body"))
+	}))
+
+	get(h, "/get", nil)
+	assert.Equal(t, "HIT", get(h, "/get", nil).Header().Get(statusHeader))
+	clock.Add(2 * time.Minute)
+	assert.Equal(t, "MISS", get(h, "/get", nil).Header().Get(statusHeader))
+}
+
+func TestCache_Vary(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	var upstream int64
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstream, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+
+	en, vi := http.Header{"Accept-Language": {"en"}}, http.Header{"Accept-Language": {"vi"}}
+	assert.Equal(t, "en", get(h, "/get", en).Body.String())
+	assert.Equal(t, "vi", get(h, "/get", vi).Body.String())
+	w := get(h, "/get", en)
+	assert.Equal(t, "HIT", w.Header().Get(statusHeader))
+	assert.Equal(t, "en", w.Body.String())
+	w = get(h, "/get", vi)
+	assert.Equal(t, "HIT", w.Header().Get(statusHeader))
+	assert.Equal(t, "vi", w.Body.String())
+	assert.Equal(t, int64(2), upstream)
+}
+
+func TestCache_Revalidate(t *testing.T) {
+	c, clock := newTestCache(t, Options{})
+	var upstream, notModified int64
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstream, 1)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	}))
+
+	get(h, "/get", nil)
+	clock.Add(time.Minute)
+	w := get(h, "/get", nil)
+	assert.Equal(t, "REVALIDATED", w.Header().Get(statusHeader))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body", w.Body.String())
+	assert.Equal(t, int64(1), notModified)
+
+	// the 304 freshened the entry
+	assert.Equal(t, "HIT", get(h, "/get", nil).Header().Get(statusHeader))
+	assert.Equal(t, int64(2), upstream)
+
+	// the client's own validators are answered from the cache
+	w = get(h, "/get", http.Header{"If-None-Match": {`"v1"`}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, int64(2), upstream)
+}
+
+func TestCache_RevalidateLarge(t *testing.T) {
+	c, clock := newTestCache(t, Options{MaxObjectBytes: 8})
+	body := "small"
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"`+body+`"`)
+		w.Write([]byte(body[:4]))
+		w.Write([]byte(body[4:]))
+	}))
+
+	get(h, "/get", nil)
+	clock.Add(time.Minute)
+	// The new version is over the entry size, it's streamed instead of buffered
+	body = "a much larger body"
+	w := get(h, "/get", nil)
+	assert.Equal(t, "MISS", w.Header().Get(statusHeader))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, body, w.Body.String())
+	assert.Equal(t, `"a much larger body"`, w.Header().Get("ETag"))
+
+	// and not stored
+	w = get(h, "/get", nil)
+	assert.Equal(t, "MISS", w.Header().Get(statusHeader))
+	assert.Equal(t, body, w.Body.String())
+}
+
+func TestCache_CollapseMisses(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	var upstream int64
+	release := make(chan struct{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstream, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "body", get(h, "/get", nil).Body.String())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int64(1), upstream)
+}
+
+func TestCache_UnsafeMethodInvalidates(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+
+	get(h, "/get", nil)
+	assert.Equal(t, "HIT", get(h, "/get", nil).Header().Get(statusHeader))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/get", nil))
+	assert.Equal(t, "MISS", get(h, "/get", nil).Header().Get(statusHeader))
+}
+
+func TestCache_Purge(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+
+	get(h, "/get", nil)
+	get(h, "/api/a", nil)
+	get(h, "/api/b", nil)
+
+	assert.Equal(t, 1, c.Purge(&url.URL{Host: "example.com", Path: "/get"}))
+	assert.Equal(t, 2, c.PurgePrefix("example.com/api/"))
+	assert.Equal(t, "MISS", get(h, "/api/a", nil).Header().Get(statusHeader))
+}
+
+func TestCache_Partition(t *testing.T) {
+	c, _ := newTestCache(t, Options{Partition: func(r *http.Request) string { return r.Header.Get("X-Side") }})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("side " + r.Header.Get("X-Side")))
+	}))
+
+	get(h, "/get", nil)
+	assert.Equal(t, "MISS", get(h, "/get", http.Header{"X-Side": {"b"}}).Header().Get(statusHeader))
+	w := get(h, "/get", http.Header{"X-Side": {"b"}})
+	assert.Equal(t, "HIT", w.Header().Get(statusHeader))
+	assert.Equal(t, "side b", w.Body.String())
+	assert.Equal(t, "side ", get(h, "/get", nil).Body.String())
+
+	// Purging the URL removes all its partitions
+	assert.Equal(t, 2, c.Purge(&url.URL{Host: "example.com", Path: "/get"}))
+}
+
+func TestCache_MemoryBudget(t *testing.T) {
+	c, _ := newTestCache(t, Options{MaxBytes: 300, MaxObjectBytes: 300})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(make([]byte, 100))
+	}))
+
+	get(h, "/1", nil)
+	get(h, "/2", nil)
+	get(h, "/3", nil)
+	assert.Equal(t, "MISS", get(h, "/1", nil).Header().Get(statusHeader))
+	assert.Equal(t, "HIT", get(h, "/3", nil).Header().Get(statusHeader))
+}
+
+func TestCache_DiskTier(t *testing.T) {
+	dir := t.TempDir()
+	handler := func(c *Cache) http.Handler {
+		return c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("body"))
+		}))
+	}
+
+	c, _ := newTestCache(t, Options{Dir: dir, MaxDiskBytes: 1 << 20})
+	get(handler(c), "/get", nil)
+
+	// a new cache over the same directory starts with the stored entries
+	c, _ = newTestCache(t, Options{Dir: dir, MaxDiskBytes: 1 << 20})
+	w := get(handler(c), "/get", nil)
+	assert.Equal(t, "HIT", w.Header().Get(statusHeader))
+	assert.Equal(t, "body", w.Body.String())
+}
+
+// unwrapWriter only exposes the writer it wraps, like the status writers of the proxy
+type unwrapWriter struct {
+	http.ResponseWriter
+}
+
+func (u unwrapWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+func TestCache_FlushOnMiss(t *testing.T) {
+	c, _ := newTestCache(t, Options{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte("{}\n"))
+		http.NewResponseController(w).Flush()
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(unwrapWriter{w}, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.Equal(t, "MISS", w.Header().Get(statusHeader))
+	assert.True(t, w.Flushed)
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// diskStore keeps gob encoded entries as files in a directory, one file per key.
+// The index of keys is kept in memory as an LRU bounded by the files' total size
+// and is rebuilt from the directory content on startup.
+type diskStore struct {
+	dir   string
+	mutex sync.Mutex
+	index *lru[string]
+}
+
+func newDiskStore(dir string, maxBytes int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskStore{dir: dir}
+	d.index = newLRU[string](maxBytes, func(_ string, file string) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Printf("cache: could not remove %s: %v", file, err)
+		}
+	})
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.entry"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		e, err := readEntry(file)
+		if err != nil {
+			log.Printf("cache: dropping unreadable %s: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		d.index.add(e.Key, file, info.Size())
+	}
+	return d, nil
+}
+
+func (d *diskStore) get(key string) (*entry, bool) {
+	d.mutex.Lock()
+	file, ok := d.index.get(key)
+	d.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	e, err := readEntry(file)
+	if err != nil {
+		return nil, false
+	}
+	return e, true
+}
+
+func (d *diskStore) set(e *entry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		log.Printf("cache: could not encode %s: %v", e.Key, err)
+		return
+	}
+
+	file := d.fileName(e.Key)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		log.Printf("cache: could not write %s: %v", tmp, err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := os.Rename(tmp, file); err != nil {
+		log.Printf("cache: could not write %s: %v", file, err)
+		return
+	}
+	if !d.index.add(e.Key, file, int64(buf.Len())) {
+		os.Remove(file)
+	}
+}
+
+func (d *diskStore) purge(match func(key string) bool) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	removed := 0
+	for _, key := range d.index.keys() {
+		if match(key) && d.index.remove(key) {
+			removed++
+		}
+	}
+	return removed
+}
+
+func (d *diskStore) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".entry")
+}
+
+func readEntry(file string) (*entry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e := &entry{}
+	if err := gob.NewDecoder(f).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
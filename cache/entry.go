@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy/auth"
+)
+
+// heuristicStatus lists the status codes that are cacheable by default (RFC 9110 section 15.1)
+// and may get a heuristic freshness lifetime when the origin declares none.
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// maxHeuristicLifetime caps the freshness computed from Last-Modified
+const maxHeuristicLifetime = 24 * time.Hour
+
+// entry is a stored response. When Vary is set the entry is only a marker telling
+// which request headers select the variant, the variants are stored under their own keys.
+type entry struct {
+	Key          string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time // when the request that produced the response was sent upstream
+	ResponseTime time.Time // when the response was received
+	Vary         []string
+}
+
+// size approximates the memory used by the entry, it's what counts against the byte budget
+func (e *entry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, vs := range e.Header {
+		n += int64(len(k))
+		for _, v := range vs {
+			n += int64(len(v))
+		}
+	}
+	for _, v := range e.Vary {
+		n += int64(len(v))
+	}
+	return n
+}
+
+// date returns the origin's Date header, or the response time when it's missing or invalid
+func (e *entry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime implements RFC 9111 section 4.2.1 for a shared cache
+func (e *entry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// an invalid Expires means the response is already expired
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if !heuristicStatus[e.Status] {
+		return 0
+	}
+	// heuristic freshness: 10% of the time since the representation was last modified
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		return min(e.date().Sub(lastModified)/10, maxHeuristicLifetime)
+	}
+	return 0
+}
+
+// age implements the current_age calculation of RFC 9111 section 4.2.3
+func (e *entry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+func (e *entry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// storable tells whether a response to r may be stored by a shared cache (RFC 9111 section 3)
+func storable(r *http.Request, status int, header http.Header) bool {
+	if r.Method != http.MethodGet || status < 200 || status == http.StatusPartialContent {
+		return false
+	}
+	reqCC, respCC := parseCacheControl(r.Header), parseCacheControl(header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return false
+	}
+	// event streams never end, they can't be stored
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	// The credentials may have been removed by the auth middleware, which leaves the identity
+	authenticated := r.Header.Get("Authorization") != "" || auth.FromContext(r.Context()) != nil
+	if authenticated &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	return respCC.has("public") || respCC.has("max-age") || respCC.has("s-maxage") ||
+		header.Get("Expires") != "" || heuristicStatus[status]
+}
@@ -0,0 +1,44 @@
+package cache
+
+import "sync"
+
+// flight collapses concurrent calls for the same key: the first caller runs the function
+// while the others wait for it to return.
+type flight struct {
+	mutex sync.Mutex
+	calls map[string]*sync.WaitGroup
+}
+
+// do runs fn unless a call for key is already in flight, in which case it waits for
+// that call to finish. It reports whether fn was run by this caller.
+// fn may call release to let the waiters go before it returns.
+func (f *flight) do(key string, fn func(release func())) (leader bool) {
+	f.mutex.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*sync.WaitGroup)
+	}
+	if wg, ok := f.calls[key]; ok {
+		f.mutex.Unlock()
+		wg.Wait()
+		return false
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	f.calls[key] = wg
+	f.mutex.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			f.mutex.Lock()
+			delete(f.calls, key)
+			f.mutex.Unlock()
+			wg.Done()
+		})
+	}
+	// fn may panic with http.ErrAbortHandler when the client goes away,
+	// the waiters must be released anyway
+	defer release()
+	fn(release)
+	return true
+}
@@ -0,0 +1,86 @@
+package cache
+
+import "container/list"
+
+type lruItem[V any] struct {
+	key   string
+	value V
+	size  int64
+}
+
+// lru is a least recently used list bounded by the sum of its item sizes.
+// It's not safe for concurrent use, the stores wrapping it hold the lock.
+type lru[V any] struct {
+	maxBytes  int64
+	usedBytes int64
+	ll        *list.List
+	items     map[string]*list.Element
+	onEvict   func(key string, value V)
+}
+
+func newLRU[V any](maxBytes int64, onEvict func(key string, value V)) *lru[V] {
+	return &lru[V]{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+// get returns the value for key and marks it as recently used
+func (l *lru[V]) get(key string) (value V, ok bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return value, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem[V]).value, true
+}
+
+// add inserts or replaces the value for key, then evicts the least recently used items
+// until the budget is met. Items bigger than the whole budget are not added.
+func (l *lru[V]) add(key string, value V, size int64) bool {
+	if size > l.maxBytes {
+		l.remove(key)
+		return false
+	}
+	if el, ok := l.items[key]; ok {
+		item := el.Value.(*lruItem[V])
+		l.usedBytes += size - item.size
+		item.value, item.size = value, size
+		l.ll.MoveToFront(el)
+	} else {
+		l.items[key] = l.ll.PushFront(&lruItem[V]{key: key, value: value, size: size})
+		l.usedBytes += size
+	}
+	for l.usedBytes > l.maxBytes {
+		l.evict(l.ll.Back())
+	}
+	return true
+}
+
+func (l *lru[V]) remove(key string) bool {
+	el, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.evict(el)
+	return true
+}
+
+func (l *lru[V]) evict(el *list.Element) {
+	item := l.ll.Remove(el).(*lruItem[V])
+	delete(l.items, item.key)
+	l.usedBytes -= item.size
+	if l.onEvict != nil {
+		l.onEvict(item.key, item.value)
+	}
+}
+
+func (l *lru[V]) keys() []string {
+	keys := make([]string, 0, len(l.items))
+	for k := range l.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
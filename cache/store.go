@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"sync"
+)
+
+// store is the interface that represents a cache tier.
+// Any struct that implements store should be safe for concurrent use.
+type store interface {
+	// get returns the entry stored for key
+	get(key string) (*entry, bool)
+	// set stores the entry under its key, it may evict other entries to stay in budget
+	set(e *entry)
+	// purge removes every entry whose key matches and returns how many were removed
+	purge(match func(key string) bool) int
+}
+
+// memoryStore keeps entries in an in-memory LRU bounded by a byte budget
+type memoryStore struct {
+	mutex sync.Mutex
+	lru   *lru[*entry]
+}
+
+func newMemoryStore(maxBytes int64) *memoryStore {
+	return &memoryStore{lru: newLRU[*entry](maxBytes, nil)}
+}
+
+func (m *memoryStore) get(key string) (*entry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lru.get(key)
+}
+
+func (m *memoryStore) set(e *entry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lru.add(e.Key, e, e.size())
+}
+
+func (m *memoryStore) purge(match func(key string) bool) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := 0
+	for _, key := range m.lru.keys() {
+		if match(key) && m.lru.remove(key) {
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// teeWriter forwards the response to the client while recording it for the cache.
+// Recording stops once the body goes over maxBytes, the client still gets all of it.
+type teeWriter struct {
+	http.ResponseWriter
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	maxBytes  int64
+	truncated bool
+	onHeader  func(status int, header http.Header)
+}
+
+func (t *teeWriter) WriteHeader(status int) {
+	if status < 200 {
+		t.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if t.status != 0 {
+		return
+	}
+	t.status = status
+	t.header = t.ResponseWriter.Header().Clone()
+	if t.onHeader != nil {
+		t.onHeader(status, t.header)
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if !t.truncated {
+		if int64(t.body.Len()+len(p)) > t.maxBytes {
+			t.truncated = true
+			t.body = bytes.Buffer{}
+		} else {
+			t.body.Write(p)
+		}
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *teeWriter) Flush() {
+	http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+func (t *teeWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// recorder buffers a response, it's used for revalidation where the upstream answer
+// is not necessarily the one sent to the client. A body going over maxBytes can't be
+// stored, the response is then streamed to the client w as it comes.
+type recorder struct {
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	maxBytes int64
+	w        http.ResponseWriter
+	streamed bool
+}
+
+func newRecorder(w http.ResponseWriter, maxBytes int64) *recorder {
+	return &recorder{header: http.Header{}, w: w, maxBytes: maxBytes}
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.streamed {
+		return r.w.Write(p)
+	}
+	if int64(r.body.Len()+len(p)) <= r.maxBytes {
+		return r.body.Write(p)
+	}
+	// Too big to be stored, what was buffered is sent and the rest goes straight through
+	r.streamed = true
+	header := r.w.Header()
+	for k, vs := range r.header {
+		header[k] = vs
+	}
+	header.Set(statusHeader, "MISS")
+	r.w.WriteHeader(r.status)
+	if _, err := r.w.Write(r.body.Bytes()); err != nil {
+		return 0, err
+	}
+	r.body = bytes.Buffer{}
+	return r.w.Write(p)
+}
+
+func (r *recorder) Flush() {
+	if r.streamed {
+		http.NewResponseController(r.w).Flush()
+	}
+}
+
+// statusWriter captures the status code of a response passed through untouched
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,70 @@
+// Package compress implements response compression negotiated from Accept-Encoding.
+//
+// Bodies are compressed with zstd, gzip or deflate while they are streamed, only the first
+// MinSize bytes are held back to decide whether the response is worth compressing.
+package compress
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Options configures the compression middleware
+type Options struct {
+	// MinSize is the body size under which responses are sent as is
+	MinSize int
+	// ContentTypes lists the media types, or media type prefixes ending with "/", that are compressed
+	ContentTypes []string
+}
+
+// DefaultOptions compresses textual responses of at least 1KB
+var DefaultOptions = Options{
+	MinSize: 1024,
+	ContentTypes: []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/problem+json",
+		"image/svg+xml",
+	},
+}
+
+// Handler wraps h with response compression
+func Handler(h http.Handler, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			opts:           &opts,
+			encoding:       negotiate(r.Header),
+			head:           r.Method == http.MethodHead,
+		}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressible tells whether a response with the given Content-Type is in the allow-list
+func (o *Options) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	// event streams are flushed message by message, they're left alone
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	for _, allowed := range o.ContentTypes {
+		if mediaType == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed)) {
+			return true
+		}
+	}
+	return false
+}
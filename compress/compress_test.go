@@ -0,0 +1,158 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{name: "none", acceptEncoding: "", want: ""},
+		{name: "gzip", acceptEncoding: "gzip", want: "gzip"},
+		{name: "preference_order", acceptEncoding: "deflate, gzip, zstd", want: "zstd"},
+		{name: "qvalues", acceptEncoding: "zstd;q=0.5, deflate;q=0.8, gzip;q=0.1", want: "deflate"},
+		{name: "refused", acceptEncoding: "gzip;q=0, identity", want: ""},
+		{name: "wildcard", acceptEncoding: "*;q=0.5, zstd;q=0", want: "gzip"},
+		{name: "unsupported", acceptEncoding: "br", want: ""},
+	}
+	for _, tt := range tests {
+		enc := negotiate(http.Header{"Accept-Encoding": {tt.acceptEncoding}})
+		got := ""
+		if enc != nil {
+			got = enc.name
+		}
+		assert.Equal(t, tt.want, got, tt.name)
+	}
+}
+
+func decode(t *testing.T, encoding string, body io.Reader) string {
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(body)
+		assert.NoError(t, err)
+		r = gr
+	case "deflate":
+		r = flate.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		assert.NoError(t, err)
+		defer zr.Close()
+		r = zr
+	default:
+		r = body
+	}
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestHandler(t *testing.T) {
+	large := strings.Repeat("origin server response\n", 100)
+	tests := []struct {
+		name            string
+		acceptEncoding  string
+		contentType     string
+		contentEncoding string
+		body            string
+		wantEncoding    string
+	}{
+		{name: "gzip", acceptEncoding: "gzip", contentType: "text/plain", body: large, wantEncoding: "gzip"},
+		{name: "deflate", acceptEncoding: "deflate", contentType: "application/json", body: large, wantEncoding: "deflate"},
+		{name: "zstd", acceptEncoding: "zstd", contentType: "text/html; charset=utf-8", body: large, wantEncoding: "zstd"},
+		{name: "sniffed_type", acceptEncoding: "gzip", body: large, wantEncoding: "gzip"},
+		{name: "small", acceptEncoding: "gzip", contentType: "text/plain", body: "small", wantEncoding: ""},
+		{name: "not_allowed_type", acceptEncoding: "gzip", contentType: "image/png", body: large, wantEncoding: ""},
+		{name: "already_encoded", acceptEncoding: "gzip", contentType: "text/plain", contentEncoding: "br", body: large, wantEncoding: "br"},
+		{name: "not_accepted", acceptEncoding: "", contentType: "text/plain", body: large, wantEncoding: ""},
+	}
+	for _, tt := range tests {
+		h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType != "" {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			if tt.contentEncoding != "" {
+				w.Header().Set("Content-Encoding", tt.contentEncoding)
+			}
+			// write in pieces to go through the held back buffer
+			for i := 0; i < len(tt.body); i += 100 {
+				io.WriteString(w, tt.body[i:min(i+100, len(tt.body))])
+			}
+		}), DefaultOptions)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, tt.wantEncoding, w.Header().Get("Content-Encoding"), tt.name)
+		if tt.wantEncoding != "" && tt.wantEncoding != tt.contentEncoding {
+			assert.Empty(t, w.Header().Get("Content-Length"), tt.name)
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), tt.name)
+			assert.Equal(t, tt.body, decode(t, tt.wantEncoding, w.Body), tt.name)
+		} else {
+			assert.Equal(t, tt.body, w.Body.String(), tt.name)
+		}
+	}
+}
+
+func TestHandler_ContentLength(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "2000")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(strings.Repeat("a", 2000)))
+	}), DefaultOptions)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Content-Length"))
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+	assert.Equal(t, strings.Repeat("a", 2000), decode(t, "gzip", w.Body))
+}
+
+func TestHandler_Streaming(t *testing.T) {
+	flushed := make(chan struct{})
+	proceed := make(chan struct{})
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first chunk\n"))
+		w.(http.Flusher).Flush()
+		close(flushed)
+		<-proceed
+		w.Write([]byte("second chunk\n"))
+	}), DefaultOptions)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, r)
+		close(done)
+	}()
+
+	<-flushed
+	// the first chunk reached the client before the handler returned
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	close(proceed)
+	<-done
+	assert.Equal(t, "first chunk\nsecond chunk\n", decode(t, "gzip", w.Body))
+}
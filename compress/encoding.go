@@ -0,0 +1,105 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressing writer that can be flushed mid-stream and reused
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoding is a content-coding the middleware can produce
+type encoding struct {
+	name string
+	pool sync.Pool
+}
+
+// encodings are listed by preference, it's used to break ties between equal q-values
+var encodings = []*encoding{
+	{name: "zstd", pool: sync.Pool{New: func() any {
+		// the window is kept small to bound the memory used by each open stream
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithWindowSize(1<<20), zstd.WithEncoderConcurrency(1))
+		return enc
+	}}},
+	{name: "gzip", pool: sync.Pool{New: func() any {
+		enc, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return enc
+	}}},
+	{name: "deflate", pool: sync.Pool{New: func() any {
+		enc, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return enc
+	}}},
+}
+
+func (e *encoding) get(w io.Writer) encoder {
+	enc := e.pool.Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func (e *encoding) put(enc encoder) {
+	e.pool.Put(enc)
+}
+
+// negotiate picks the preferred encoding allowed by the Accept-Encoding header (RFC 9110 section 12.5.3).
+// It returns nil when the response must be sent unencoded.
+func negotiate(h http.Header) *encoding {
+	type candidate struct {
+		enc *encoding
+		q   float64
+		pos int
+	}
+
+	qvalues := map[string]float64{}
+	for _, line := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(line, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				parsed, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+				q = parsed
+			}
+			qvalues[name] = q
+		}
+	}
+
+	var candidates []candidate
+	for pos, enc := range encodings {
+		q, ok := qvalues[enc.name]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > 0 {
+			candidates = append(candidates, candidate{enc: enc, q: q, pos: pos})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].pos < candidates[j].pos
+	})
+	return candidates[0].enc
+}
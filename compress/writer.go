@@ -0,0 +1,155 @@
+package compress
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressWriter holds back the beginning of the body until it knows whether the response
+// should be compressed, then streams it through the negotiated encoder or as is.
+type compressWriter struct {
+	http.ResponseWriter
+	opts     *Options
+	encoding *encoding // nil when the client accepts no supported encoding
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided || c.status != 0 {
+		return
+	}
+	if status < 200 {
+		// informational responses go straight to the client
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	c.status = status
+
+	header := c.Header()
+	if c.head || status == http.StatusNoContent || status == http.StatusNotModified {
+		c.decide(false)
+		return
+	}
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		c.decide(err == nil && n >= c.opts.MinSize)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.decided {
+		if c.enc != nil {
+			return c.enc.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+	if len(c.buf) >= c.opts.MinSize {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what's been written so far, it's taken as a sign of a streamed response
+// so a response not decided yet is compressed whatever its size.
+func (c *compressWriter) Flush() {
+	if c.status == 0 {
+		return
+	}
+	if !c.decided {
+		c.decide(true)
+	}
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close ends the response once the handler returned
+func (c *compressWriter) close() {
+	if c.status == 0 {
+		return
+	}
+	if !c.decided {
+		// the whole body is smaller than MinSize
+		if c.Header().Get("Content-Length") == "" {
+			c.Header().Set("Content-Length", strconv.Itoa(len(c.buf)))
+		}
+		c.decide(false)
+	}
+	if c.enc != nil {
+		c.enc.Close()
+		c.encoding.put(c.enc)
+		c.enc = nil
+	}
+}
+
+// decide writes the response header, compressing the body when large is true and the
+// response qualifies, then sends the held back bytes.
+func (c *compressWriter) decide(large bool) error {
+	c.decided = true
+	header := c.Header()
+
+	if header.Get("Content-Type") == "" && len(c.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	eligible := c.opts.compressible(header.Get("Content-Type")) &&
+		header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" &&
+		c.status != http.StatusPartialContent
+	if eligible {
+		addVary(header, "Accept-Encoding")
+	}
+
+	if eligible && large && c.encoding != nil && !c.head {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", c.encoding.name)
+		// the encoded representation is not byte-identical to the origin's one
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		c.ResponseWriter.WriteHeader(c.status)
+		c.enc = c.encoding.get(c.ResponseWriter)
+		if len(c.buf) > 0 {
+			if _, err := c.enc.Write(c.buf); err != nil {
+				return err
+			}
+		}
+	} else {
+		c.ResponseWriter.WriteHeader(c.status)
+		if len(c.buf) > 0 && !c.head {
+			if _, err := c.ResponseWriter.Write(c.buf); err != nil {
+				return err
+			}
+		}
+	}
+	c.buf = nil
+	return nil
+}
+
+func addVary(header http.Header, field string) {
+	for _, line := range header.Values("Vary") {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v == "*" || strings.EqualFold(v, field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
@@ -0,0 +1,38 @@
+// Package discovery finds the servers of a pool and follows their changes.
+package discovery
+
+import (
+	"context"
+	"slices"
+)
+
+// Provider discovers a set of server URLs
+type Provider interface {
+	// Watch calls update with the full set of server URLs, first as soon as it's known,
+	// then every time it changes, until ctx is done. Failed lookups keep the previous set.
+	Watch(ctx context.Context, update func(servers []string))
+}
+
+// Static is a fixed set of server URLs
+type Static []string
+
+func (s Static) Watch(ctx context.Context, update func(servers []string)) {
+	update(slices.Clone(s))
+}
+
+// changes wraps update to only call it when the set of servers differs from the previous one
+func changes(update func(servers []string)) func(servers []string) {
+	var last []string
+	first := true
+	return func(servers []string) {
+		servers = slices.Clone(servers)
+		slices.Sort(servers)
+		servers = slices.Compact(servers)
+		if !first && slices.Equal(servers, last) {
+			return
+		}
+		first = false
+		last = servers
+		update(slices.Clone(servers))
+	}
+}
@@ -0,0 +1,255 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS resolves Name periodically, each record giving a server URL. The records are looked
+// up again when their TTL expires, within MinInterval and MaxInterval.
+//
+// With A and AAAA records the servers are Scheme://address:Port. SRV records give the port
+// and target of each server, the targets are resolved through the additional records or
+// with A and AAAA queries.
+type DNS struct {
+	Name   string
+	Type   string // A, AAAA, SRV, or empty for both A and AAAA
+	Scheme string // defaults to http
+	Port   int    // defaults to the scheme's port, unused with SRV
+	// Resolver is the DNS server address, defaults to the first nameserver of /etc/resolv.conf
+	Resolver    string
+	MinInterval time.Duration // defaults to 1s
+	MaxInterval time.Duration // defaults to 5m
+}
+
+func (d *DNS) Watch(ctx context.Context, update func(servers []string)) {
+	minInterval, maxInterval := d.MinInterval, d.MaxInterval
+	if minInterval <= 0 {
+		minInterval = time.Second
+	}
+	if maxInterval <= 0 {
+		maxInterval = 5 * time.Minute
+	}
+	update = changes(update)
+
+	for {
+		servers, ttl, err := d.Lookup(ctx)
+		if err != nil {
+			log.Printf("discovery: %v", err)
+			ttl = minInterval
+		} else {
+			update(servers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(min(max(ttl, minInterval), maxInterval)):
+		}
+	}
+}
+
+// Lookup resolves the servers once, it returns them with the smallest TTL of their records
+func (d *DNS) Lookup(ctx context.Context) ([]string, time.Duration, error) {
+	resolver := d.Resolver
+	if resolver == "" {
+		var err error
+		if resolver, err = systemResolver(); err != nil {
+			return nil, 0, err
+		}
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	name, err := dnsmessage.NewName(fqdn(d.Name))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ttl uint32 = 1<<32 - 1
+	var servers []string
+	addServer := func(host string, port int) {
+		servers = append(servers, (&url.URL{Scheme: scheme, Host: net.JoinHostPort(host, strconv.Itoa(port))}).String())
+	}
+
+	recordType := strings.ToUpper(d.Type)
+	switch recordType {
+	case "SRV":
+		answers, additionals, err := query(ctx, resolver, name, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, srv := range answers {
+			body, ok := srv.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			ttl = min(ttl, srv.Header.TTL)
+			addresses, addressTTL, err := resolve(ctx, resolver, body.Target, additionals)
+			if err != nil {
+				return nil, 0, err
+			}
+			ttl = min(ttl, addressTTL)
+			for _, address := range addresses {
+				addServer(address, int(body.Port))
+			}
+		}
+	case "A", "AAAA", "":
+		port := d.Port
+		if port == 0 {
+			port = 80
+			if scheme == "https" {
+				port = 443
+			}
+		}
+		types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+		if recordType == "A" {
+			types = types[:1]
+		} else if recordType == "AAAA" {
+			types = types[1:]
+		}
+		for _, t := range types {
+			answers, _, err := query(ctx, resolver, name, t)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, address := range addressesOf(answers, nil) {
+				addServer(address.ip, port)
+				ttl = min(ttl, address.ttl)
+			}
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported DNS record type %s", d.Type)
+	}
+
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("no %s records for %s", d.Type, d.Name)
+	}
+	return servers, time.Duration(ttl) * time.Second, nil
+}
+
+type address struct {
+	ip  string
+	ttl uint32
+}
+
+// addressesOf returns the A and AAAA records in resources, only those of name when it's set.
+// The answers to a query are all for the queried name, or the names it's an alias of.
+func addressesOf(resources []dnsmessage.Resource, name *dnsmessage.Name) []address {
+	var addresses []address
+	for _, r := range resources {
+		if name != nil && !strings.EqualFold(r.Header.Name.String(), name.String()) {
+			continue
+		}
+		switch body := r.Body.(type) {
+		case *dnsmessage.AResource:
+			addresses = append(addresses, address{net.IP(body.A[:]).String(), r.Header.TTL})
+		case *dnsmessage.AAAAResource:
+			addresses = append(addresses, address{net.IP(body.AAAA[:]).String(), r.Header.TTL})
+		}
+	}
+	return addresses
+}
+
+// resolve returns the addresses of an SRV target with their smallest TTL,
+// from the additional records of the SRV response when they're there
+func resolve(ctx context.Context, resolver string, target dnsmessage.Name, additionals []dnsmessage.Resource) ([]string, uint32, error) {
+	found := addressesOf(additionals, &target)
+	if len(found) == 0 {
+		for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			answers, _, err := query(ctx, resolver, target, t)
+			if err != nil {
+				return nil, 0, err
+			}
+			found = append(found, addressesOf(answers, nil)...)
+		}
+	}
+	var addresses []string
+	var ttl uint32 = 1<<32 - 1
+	for _, a := range found {
+		addresses = append(addresses, a.ip)
+		ttl = min(ttl, a.ttl)
+	}
+	return addresses, ttl, nil
+}
+
+// query sends one question to the resolver over UDP, a name without records is not an error
+func query(ctx context.Context, resolver string, name dnsmessage.Name, t dnsmessage.Type) (answers, additionals []dnsmessage.Resource, err error) {
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("DNS query %s %s: %w", t, name, err)
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil || response.ID != id || !response.Response {
+			continue // not the answer to this query
+		}
+		switch response.RCode {
+		case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		default:
+			return nil, nil, fmt.Errorf("DNS query %s %s: %s", t, name, response.RCode)
+		}
+		if response.Truncated {
+			return nil, nil, fmt.Errorf("DNS query %s %s: truncated response", t, name)
+		}
+		return response.Answers, response.Additionals, nil
+	}
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf
+func systemResolver() (string, error) {
+	b, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
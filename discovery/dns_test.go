@@ -0,0 +1,213 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a DNS stand-in answering from its records over UDP on localhost
+type dnsServer struct {
+	addr    string
+	mutex   sync.Mutex
+	records map[dnsmessage.Type][]dnsmessage.Resource
+	queries int
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &dnsServer{addr: conn.LocalAddr().String(), records: map[dnsmessage.Type][]dnsmessage.Resource{}}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			q := msg.Questions[0]
+
+			s.mutex.Lock()
+			s.queries++
+			msg.Header.Response = true
+			msg.Answers, msg.Additionals = nil, nil
+			for _, r := range s.records[q.Type] {
+				if r.Header.Name == q.Name {
+					msg.Answers = append(msg.Answers, r)
+				}
+			}
+			if q.Type == dnsmessage.TypeSRV {
+				msg.Additionals = s.records[dnsmessage.TypeA]
+			}
+			s.mutex.Unlock()
+
+			packet, err := msg.Pack()
+			if err == nil {
+				conn.WriteTo(packet, addr)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *dnsServer) set(records ...dnsmessage.Resource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = map[dnsmessage.Type][]dnsmessage.Resource{}
+	for _, r := range records {
+		s.records[r.Header.Type] = append(s.records[r.Header.Type], r)
+	}
+}
+
+func header(name string, t dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func a(name string, ip [4]byte, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeA, ttl), Body: &dnsmessage.AResource{A: ip}}
+}
+
+func aaaa(name string, ip string, ttl uint32) dnsmessage.Resource {
+	var b [16]byte
+	copy(b[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeAAAA, ttl), Body: &dnsmessage.AAAAResource{AAAA: b}}
+}
+
+func srv(name, target string, port uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypeSRV, ttl),
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port},
+	}
+}
+
+func TestDNS_Lookup(t *testing.T) {
+	dns := newDNSServer(t)
+	dns.set(
+		a("api.test.", [4]byte{10, 0, 0, 1}, 30),
+		a("api.test.", [4]byte{10, 0, 0, 2}, 10),
+		aaaa("api.test.", "fd00::1", 60),
+		srv("_http._tcp.api.test.", "node1.test.", 8081, 20),
+		srv("_http._tcp.api.test.", "node2.test.", 8082, 20),
+		a("node1.test.", [4]byte{10, 0, 1, 1}, 5),
+		a("node2.test.", [4]byte{10, 0, 1, 2}, 40),
+	)
+
+	tests := []struct {
+		name    string
+		dns     DNS
+		want    []string
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{
+			name:    "A",
+			dns:     DNS{Name: "api.test", Type: "A", Port: 8080},
+			want:    []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"},
+			wantTTL: 10 * time.Second,
+		},
+		{
+			name:    "AAAA",
+			dns:     DNS{Name: "api.test", Type: "aaaa", Scheme: "https"},
+			want:    []string{"https://[fd00::1]:443"},
+			wantTTL: time.Minute,
+		},
+		{
+			name:    "A and AAAA",
+			dns:     DNS{Name: "api.test."},
+			want:    []string{"http://10.0.0.1:80", "http://10.0.0.2:80", "http://[fd00::1]:80"},
+			wantTTL: 10 * time.Second,
+		},
+		{
+			name:    "SRV",
+			dns:     DNS{Name: "_http._tcp.api.test", Type: "SRV"},
+			want:    []string{"http://10.0.1.1:8081", "http://10.0.1.2:8082"},
+			wantTTL: 5 * time.Second,
+		},
+		{
+			name:    "no records",
+			dns:     DNS{Name: "unknown.test", Type: "A"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported type",
+			dns:     DNS{Name: "api.test", Type: "MX"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dns.Resolver = dns.addr
+			got, ttl, err := tt.dns.Lookup(context.Background())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.want, got)
+			assert.Equal(t, tt.wantTTL, ttl)
+		})
+	}
+}
+
+func TestDNS_Watch(t *testing.T) {
+	dns := newDNSServer(t)
+	dns.set(a("api.test.", [4]byte{10, 0, 0, 1}, 0))
+
+	updates := make(chan []string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &DNS{Name: "api.test", Type: "A", Resolver: dns.addr, MinInterval: 10 * time.Millisecond}
+	go d.Watch(ctx, func(servers []string) { updates <- servers })
+
+	assert.Equal(t, []string{"http://10.0.0.1:80"}, <-updates)
+
+	dns.set(a("api.test.", [4]byte{10, 0, 0, 1}, 0), a("api.test.", [4]byte{10, 0, 0, 2}, 3600))
+	select {
+	case servers := <-updates:
+		assert.Equal(t, []string{"http://10.0.0.1:80", "http://10.0.0.2:80"}, servers)
+	case <-time.After(time.Second):
+		t.Fatal("the record change was not seen")
+	}
+
+	assert.Empty(t, updates, "unchanged records don't update the servers")
+}
+
+func TestDNS_Watch_ttl(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxInterval time.Duration
+		wantQueries func(queries int) bool
+	}{
+		{name: "ttl honoured", wantQueries: func(queries int) bool { return queries == 1 }},
+		{name: "ttl capped", maxInterval: 10 * time.Millisecond, wantQueries: func(queries int) bool { return queries > 2 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns := newDNSServer(t)
+			dns.set(a("api.test.", [4]byte{10, 0, 0, 1}, 3600))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			d := &DNS{Name: "api.test", Type: "A", Resolver: dns.addr, MinInterval: time.Millisecond, MaxInterval: tt.maxInterval}
+			go d.Watch(ctx, func(servers []string) {})
+
+			time.Sleep(100 * time.Millisecond)
+			dns.mutex.Lock()
+			defer dns.mutex.Unlock()
+			assert.True(t, tt.wantQueries(dns.queries), "%d queries", dns.queries)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"proxy/utils"
+)
+
+// File reads the server URLs from a JSON or YAML file, and reads it again when it changes.
+// The file holds either a list of URLs or an object with a "servers" list, YAML is
+// recognised by the .yaml and .yml extensions.
+type File struct {
+	Path     string
+	Interval time.Duration // between checks of the file modification, defaults to 1s
+}
+
+func (f *File) Watch(ctx context.Context, update func(servers []string)) {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	update = changes(update)
+
+	var modTime time.Time
+	var size int64 = -1
+	for {
+		if info, err := os.Stat(f.Path); err != nil {
+			log.Printf("discovery: %v", err)
+		} else if !info.ModTime().Equal(modTime) || info.Size() != size {
+			servers, err := f.read()
+			if err != nil {
+				log.Printf("discovery: %v", err)
+			} else {
+				modTime, size = info.ModTime(), info.Size()
+				update(servers)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (f *File) read() ([]string, error) {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	unmarshal := json.Unmarshal
+	if ext := filepath.Ext(f.Path); ext == ".yaml" || ext == ".yml" {
+		unmarshal = yaml.Unmarshal
+	}
+	var content struct {
+		Servers []string `json:"servers" yaml:"servers"`
+	}
+	if err := unmarshal(b, &content.Servers); err != nil {
+		if err := unmarshal(b, &content); err != nil {
+			return nil, fmt.Errorf("invalid servers file %s: %w", f.Path, err)
+		}
+	}
+	// A file being rewritten can be seen empty, it must not drain the pool
+	if len(content.Servers) == 0 {
+		return nil, fmt.Errorf("no servers in %s", f.Path)
+	}
+	for _, s := range content.Servers {
+		if !validServer(s) {
+			return nil, fmt.Errorf("invalid server %q in %s", s, f.Path)
+		}
+	}
+	return content.Servers, nil
+}
+
+// validServer tells whether s is a server URL the proxy can dial
+func validServer(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	_, address, _, err := utils.UpstreamAddr(u)
+	return err == nil && address != ""
+}
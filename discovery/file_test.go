@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile_read(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{name: "json list", file: "servers.json", content: `["http://a:80", "http://b:80"]`, want: []string{"http://a:80", "http://b:80"}},
+		{name: "json object", file: "servers.json", content: `{"servers": ["http://a:80"]}`, want: []string{"http://a:80"}},
+		{name: "yaml list", file: "servers.yaml", content: "- http://a:80\n- http://b:80\n", want: []string{"http://a:80", "http://b:80"}},
+		{name: "yaml object", file: "servers.yml", content: "servers:\n  - http://a:80\n", want: []string{"http://a:80"}},
+		{name: "unix socket", file: "servers.json", content: `["unix:///run/app.sock"]`, want: []string{"unix:///run/app.sock"}},
+		{name: "empty", file: "servers.json", content: ``, wantErr: true},
+		{name: "invalid url", file: "servers.json", content: `["a:b:c"]`, wantErr: true},
+		{name: "unix socket without path", file: "servers.json", content: `["unix://"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0o644))
+			got, err := (&File{Path: path}).read()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFile_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`["http://b:80", "http://a:80"]`), 0o644))
+
+	updates := make(chan []string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&File{Path: path, Interval: 5 * time.Millisecond}).Watch(ctx, func(servers []string) { updates <- servers })
+	assert.Equal(t, []string{"http://a:80", "http://b:80"}, <-updates)
+
+	// A broken file keeps the servers
+	assert.NoError(t, os.WriteFile(path, []byte(`["http://a:80",`), 0o644))
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, updates)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`["http://a:80", "http://c:80"]`), 0o644))
+	select {
+	case servers := <-updates:
+		assert.Equal(t, []string{"http://a:80", "http://c:80"}, servers)
+	case <-time.After(time.Second):
+		t.Fatal("the file change was not seen")
+	}
+}
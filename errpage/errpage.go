@@ -0,0 +1,184 @@
+// Package errpage renders the error responses of the proxy as HTML, problem+json (RFC 9457)
+// or plain text depending on what the client accepts. Every error carries a correlation ID,
+// the internal details of an error are only logged with it.
+package errpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"proxy/requestid"
+)
+
+// RequestIDHeader holds the correlation ID of a request
+const RequestIDHeader = requestid.Header
+
+// Renderer writes error responses, with HTML templates by status
+type Renderer struct {
+	templates map[string]*template.Template // by status such as "404", class such as "4xx", or "default"
+}
+
+// Default renders the errors of Write and Internal
+var Default = &Renderer{templates: map[string]*template.Template{"default": defaultTemplate}}
+
+var defaultTemplate = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Message}}</p>
+<hr><p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`))
+
+// Data is what the templates are executed with
+type Data struct {
+	Status    int
+	Title     string // the status text
+	Message   string
+	RequestID string
+	Path      string
+}
+
+// LoadTemplates returns a renderer using the HTML templates of dir, named after the status
+// they render such as 404.html, its class such as 5xx.html, or default.html.
+// The built-in page is used for the statuses without a template.
+func LoadTemplates(dir string) (*Renderer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	r := &Renderer{templates: map[string]*template.Template{"default": defaultTemplate}}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(name).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("error page %s: %w", file, err)
+		}
+		r.templates[name] = t
+	}
+	return r, nil
+}
+
+// Write answers r with an error response, message must hold no internal details
+func Write(w http.ResponseWriter, r *http.Request, status int, message string) {
+	Default.Write(w, r, status, message)
+}
+
+// Internal logs err with the correlation ID of r and answers with message
+func Internal(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	Default.Internal(w, r, status, message, err)
+}
+
+func (rd *Renderer) Internal(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	log.Printf("request %s: %s %s: %v", RequestID(r), r.Method, r.URL.Path, err)
+	rd.Write(w, r, status, message)
+}
+
+func (rd *Renderer) Write(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := Data{
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   message,
+		RequestID: RequestID(r),
+		Path:      r.URL.Path,
+	}
+
+	var body bytes.Buffer
+	var contentType string
+	switch negotiate(r.Header.Get("Accept")) {
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		if err := rd.template(status).Execute(&body, data); err != nil {
+			log.Printf("errpage: %v", err)
+			body.Reset()
+			defaultTemplate.Execute(&body, data)
+		}
+	case "json":
+		contentType = "application/problem+json"
+		json.NewEncoder(&body).Encode(map[string]any{
+			"type":       "about:blank",
+			"title":      data.Title,
+			"status":     status,
+			"detail":     message,
+			"instance":   data.Path,
+			"request_id": data.RequestID,
+		})
+	default:
+		contentType = "text/plain; charset=utf-8"
+		fmt.Fprintf(&body, "%s\nRequest ID: %s\n", message, data.RequestID)
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set(RequestIDHeader, data.RequestID)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func (rd *Renderer) template(status int) *template.Template {
+	code := strconv.Itoa(status)
+	for _, name := range []string{code, code[:1] + "xx", "default"} {
+		if t, ok := rd.templates[name]; ok {
+			return t
+		}
+	}
+	return defaultTemplate
+}
+
+// RequestID returns the correlation ID of r, one is set on the request when it has none
+func RequestID(r *http.Request) string {
+	if id := requestid.Get(r); id != "" {
+		return id
+	}
+	id := requestid.New()
+	r.Header.Set(RequestIDHeader, id)
+	return id
+}
+
+// negotiate returns the error format the Accept header prefers: html, json or plain
+func negotiate(accept string) string {
+	best, bestQ := "plain", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		var format string
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "text/html", "application/xhtml+xml":
+			format = "html"
+		case "application/problem+json", "application/json":
+			format = "json"
+		case "text/plain":
+			format = "plain"
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
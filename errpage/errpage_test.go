@@ -0,0 +1,79 @@
+package errpage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderer_Write(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "404.html"), []byte(`<p>Nothing at {{.Path}} ({{.RequestID}})</p>`), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "5xx.html"), []byte(`<p>{{.Status}} {{.Message}}</p>`), 0o644))
+	rd, err := LoadTemplates(dir)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		accept          string
+		status          int
+		wantContentType string
+		wantBody        string
+	}{
+		{name: "plain", status: 429, wantContentType: "text/plain; charset=utf-8", wantBody: "Too many requests\nRequest ID: abc\n"},
+		{name: "status template", accept: "text/html,*/*;q=0.8", status: 404, wantContentType: "text/html; charset=utf-8", wantBody: `<p>Nothing at /a&lt;b&gt; (abc)</p>`},
+		{name: "class template", accept: "text/html", status: 503, wantContentType: "text/html; charset=utf-8", wantBody: `<p>503 Too many requests</p>`},
+		{name: "json preferred", accept: "text/html;q=0.5, application/json", status: 429, wantContentType: "application/problem+json"},
+		{name: "unknown type", accept: "image/png", status: 429, wantContentType: "text/plain; charset=utf-8", wantBody: "Too many requests\nRequest ID: abc\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/a%3Cb%3E", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set(RequestIDHeader, "abc")
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Length", "42")
+			w.Header().Set("Retry-After", "1")
+			rd.Write(w, r, tt.status, "Too many requests")
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.wantContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, "abc", w.Header().Get(RequestIDHeader))
+			assert.Empty(t, w.Header().Get("Content-Length"))
+			assert.Equal(t, "1", w.Header().Get("Retry-After"), "the headers set before are kept")
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+			if tt.wantContentType == "application/problem+json" {
+				var problem map[string]any
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+				assert.Equal(t, map[string]any{
+					"type":       "about:blank",
+					"title":      "Too Many Requests",
+					"status":     float64(429),
+					"detail":     "Too many requests",
+					"instance":   "/a<b>",
+					"request_id": "abc",
+				}, problem)
+			}
+		})
+	}
+}
+
+func TestInternal(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	Internal(w, r, http.StatusInternalServerError, "Origin server error", errors.New("dial tcp 10.0.0.1:8080: connection refused"))
+
+	id := r.Header.Get(RequestIDHeader)
+	assert.Len(t, id, 26, "a correlation ID is generated")
+	assert.Equal(t, id, w.Header().Get(RequestIDHeader))
+	assert.NotContains(t, w.Body.String(), "10.0.0.1", "internal details are scrubbed")
+	assert.Contains(t, w.Body.String(), id)
+}
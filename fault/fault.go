@@ -0,0 +1,208 @@
+// Package fault injects delays, errors, truncated responses and connection resets into
+// requests, to test how clients cope with a failing proxy or origin.
+package fault
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"proxy/errpage"
+	"proxy/utils"
+)
+
+// Policy sets the faults injected into Percent of the requests, or of the requests
+// carrying Header when it's set. The faults are applied in order: delay, reset, abort
+// and truncation.
+type Policy struct {
+	Percent float64 `json:"percent"`
+	Header  string  `json:"header"`
+
+	// Delay is added before the request is handled, with a random extra up to DelayJitter
+	Delay       utils.Duration `json:"delay"`
+	DelayJitter utils.Duration `json:"delay_jitter"`
+	// Reset closes the connection with a TCP reset instead of answering
+	Reset bool `json:"reset"`
+	// AbortStatus answers with this HTTP status instead of handling the request
+	AbortStatus int `json:"abort_status"`
+	// GRPCStatus answers gRPC requests with this gRPC status code instead of handling them
+	GRPCStatus int `json:"grpc_status"`
+	// TruncateBytes cuts the response body after this many bytes when Truncate is set
+	Truncate      bool  `json:"truncate"`
+	TruncateBytes int64 `json:"truncate_bytes"`
+}
+
+// Validate checks the policy values are in range
+func (p Policy) Validate() error {
+	switch {
+	case p.Percent < 0 || p.Percent > 100:
+		return errors.New("percent must be between 0 and 100")
+	case p.Delay.Duration < 0 || p.DelayJitter.Duration < 0:
+		return errors.New("delays can't be negative")
+	case p.AbortStatus != 0 && (p.AbortStatus < 100 || p.AbortStatus > 599):
+		return errors.New("invalid abort status")
+	case p.GRPCStatus < 0 || p.GRPCStatus > 16:
+		return errors.New("invalid gRPC status")
+	case p.TruncateBytes < 0:
+		return errors.New("truncate bytes can't be negative")
+	}
+	return nil
+}
+
+// Injector applies a policy that can be changed at any time, it injects no fault until set
+type Injector struct {
+	policy atomic.Pointer[Policy]
+	// OnInject is called with the kind of each injected fault: delay, reset, abort or truncate
+	OnInject func(kind string)
+}
+
+// Set replaces the policy, nil stops the injection
+func (i *Injector) Set(policy *Policy) {
+	i.policy.Store(policy)
+}
+
+// Policy returns the current policy, nil when no fault is injected
+func (i *Injector) Policy() *Policy {
+	return i.policy.Load()
+}
+
+// Handler injects the faults of the current policy into the requests handled by h
+func (i *Injector) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := i.policy.Load()
+		if p == nil || !p.applies(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if delay := p.delay(); delay > 0 {
+			i.injected("delay")
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if p.Reset {
+			i.injected("reset")
+			reset(w)
+		}
+		if p.GRPCStatus != 0 && isGRPC(r) {
+			i.injected("abort")
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", strconv.Itoa(p.GRPCStatus))
+			w.Header().Set("Grpc-Message", "fault injected")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if p.AbortStatus != 0 {
+			i.injected("abort")
+			errpage.Write(w, r, p.AbortStatus, "Fault injected")
+			return
+		}
+		if p.Truncate {
+			tw := &truncateWriter{ResponseWriter: w, remaining: p.TruncateBytes, onTruncate: func() { i.injected("truncate") }}
+			h.ServeHTTP(tw, r)
+			if tw.truncated {
+				// Ends the response without its end, the client sees a broken body. A
+				// ReverseProxy upstream already panicked on the write error.
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (i *Injector) injected(kind string) {
+	if i.OnInject != nil {
+		i.OnInject(kind)
+	}
+}
+
+func (p *Policy) applies(r *http.Request) bool {
+	if p.Header != "" && r.Header.Get(p.Header) == "" {
+		return false
+	}
+	return p.Percent >= 100 || rand.Float64()*100 < p.Percent
+}
+
+func (p *Policy) delay() time.Duration {
+	delay := p.Delay.Duration
+	if p.DelayJitter.Duration > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.DelayJitter.Duration)))
+	}
+	return delay
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// reset closes the client connection with a TCP RST when it can be taken over,
+// otherwise the connection or HTTP/2 stream is aborted
+func reset(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	// Wrapping connections, such as the PROXY protocol ones, expose the TCP connection
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+	panic(http.ErrAbortHandler)
+}
+
+// errTruncated stops the copy of the response once the body is cut
+var errTruncated = errors.New("response truncated by fault injection")
+
+// truncateWriter cuts the response body after remaining bytes. The injection is recorded
+// and what was kept is flushed when it's cut, as the handler may not return normally
+// after the write error, ReverseProxy panics.
+type truncateWriter struct {
+	http.ResponseWriter
+	remaining  int64
+	truncated  bool
+	onTruncate func()
+}
+
+func (w *truncateWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) <= w.remaining {
+		w.remaining -= int64(len(b))
+		return w.ResponseWriter.Write(b)
+	}
+	n, err := w.ResponseWriter.Write(b[:w.remaining])
+	w.remaining = 0
+	if !w.truncated {
+		w.truncated = true
+		w.onTruncate()
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	if err == nil {
+		err = errTruncated
+	}
+	return n, err
+}
+
+func (w *truncateWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *truncateWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,181 @@
+package fault
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/proxyproto"
+	"proxy/utils"
+)
+
+func TestInjector_Handler(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *Policy
+		header     http.Header
+		wantStatus int
+		wantBody   string
+		wantGRPC   string
+		wantFaults []string
+	}{
+		{name: "off", wantStatus: http.StatusOK, wantBody: "hello world"},
+		{name: "abort", policy: &Policy{Percent: 100, AbortStatus: 503}, wantStatus: 503, wantBody: "Fault injected\nRequest ID: test\n", wantFaults: []string{"abort"}},
+		{name: "never", policy: &Policy{Percent: 0, AbortStatus: 503}, wantStatus: http.StatusOK, wantBody: "hello world"},
+		{name: "header missing", policy: &Policy{Percent: 100, Header: "X-Fault", AbortStatus: 500}, wantStatus: http.StatusOK, wantBody: "hello world"},
+		{
+			name:       "header present",
+			policy:     &Policy{Percent: 100, Header: "X-Fault", AbortStatus: 500},
+			header:     http.Header{"X-Fault": {"1"}},
+			wantStatus: 500,
+			wantBody:   "Fault injected\nRequest ID: test\n",
+			wantFaults: []string{"abort"},
+		},
+		{
+			name:       "grpc",
+			policy:     &Policy{Percent: 100, GRPCStatus: 14, AbortStatus: 503},
+			header:     http.Header{"Content-Type": {"application/grpc+proto"}},
+			wantStatus: http.StatusOK,
+			wantGRPC:   "14",
+			wantFaults: []string{"abort"},
+		},
+		{
+			name:       "delay",
+			policy:     &Policy{Percent: 100, Delay: utils.Duration{Duration: 20 * time.Millisecond}, DelayJitter: utils.Duration{Duration: time.Millisecond}},
+			wantStatus: http.StatusOK,
+			wantBody:   "hello world",
+			wantFaults: []string{"delay"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var faults []string
+			i := &Injector{OnInject: func(kind string) { faults = append(faults, kind) }}
+			i.Set(tt.policy)
+			h := i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello world")
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Request-ID", "test")
+			for k, vs := range tt.header {
+				r.Header[k] = vs
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+			assert.Equal(t, tt.wantGRPC, w.Header().Get("Grpc-Status"))
+			assert.Equal(t, tt.wantFaults, faults)
+			if tt.policy != nil && tt.policy.Delay.Duration > 0 {
+				assert.GreaterOrEqual(t, time.Since(start), tt.policy.Delay.Duration)
+			}
+		})
+	}
+}
+
+func TestInjector_connections(t *testing.T) {
+	i := &Injector{}
+	server := httptest.NewServer(i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "11")
+		io.WriteString(w, "hello ")
+		io.WriteString(w, "world")
+	})))
+	defer server.Close()
+
+	i.Set(&Policy{Percent: 100, Truncate: true, TruncateBytes: 8})
+	resp, err := http.Get(server.URL)
+	if assert.NoError(t, err) {
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Error(t, err)
+		assert.Equal(t, "hello wo", string(b))
+	}
+
+	i.Set(&Policy{Percent: 100, Reset: true})
+	_, err = http.Get(server.URL)
+	assert.Error(t, err)
+
+	i.Set(nil)
+	resp, err = http.Get(server.URL)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hello world", string(b))
+	}
+}
+
+func TestInjector_truncateReverseProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "11")
+		io.WriteString(w, "hello world")
+	}))
+	defer origin.Close()
+	target, err := url.Parse(origin.URL)
+	assert.NoError(t, err)
+
+	injected := make(chan string, 1)
+	i := &Injector{OnInject: func(kind string) { injected <- kind }}
+	i.Set(&Policy{Percent: 100, Truncate: true, TruncateBytes: 8})
+	// ReverseProxy panics on the truncation, the handler doesn't return normally
+	server := httptest.NewServer(i.Handler(httputil.NewSingleHostReverseProxy(target)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if assert.NoError(t, err) {
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Error(t, err)
+		assert.Equal(t, "hello wo", string(b))
+	}
+	select {
+	case kind := <-injected:
+		assert.Equal(t, "truncate", kind)
+	case <-time.After(time.Second):
+		t.Fatal("the truncation was not reported")
+	}
+}
+
+func TestInjector_resetBehindProxyProtocol(t *testing.T) {
+	i := &Injector{}
+	i.Set(&Policy{Percent: 100, Reset: true})
+	server := httptest.NewUnstartedServer(i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	server.Listener = proxyproto.NewListener(server.Listener, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, syscall.ECONNRESET, "a reset, not a normal close")
+}
+
+func TestPolicy_json(t *testing.T) {
+	var p Policy
+	assert.NoError(t, json.NewDecoder(strings.NewReader(`{"percent": 5, "delay": "1.5s", "abort_status": 503}`)).Decode(&p))
+	assert.Equal(t, 1500*time.Millisecond, p.Delay.Duration)
+	assert.NoError(t, p.Validate())
+
+	b, err := json.Marshal(p)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"delay":"1.5s"`)
+
+	assert.Error(t, Policy{Percent: 101}.Validate())
+	assert.Error(t, Policy{AbortStatus: 42}.Validate())
+	assert.Error(t, Policy{GRPCStatus: 17}.Validate())
+}
@@ -0,0 +1,84 @@
+// Package ipfilter allows or denies requests by client IP address.
+package ipfilter
+
+import (
+	"net/http"
+	"net/netip"
+
+	"proxy/errpage"
+	"proxy/utils"
+)
+
+// Policy filters the requests of a route. A request is blocked when its client IP is in
+// Deny, or when Allow is set and the IP isn't in it. Requests whose client IP can't be
+// parsed are blocked whenever a list is set.
+//
+// The client IP is the address of the connection, the one of its PROXY header included.
+// Forwarding headers are only believed from TrustedProxies, as any client can send them.
+type Policy struct {
+	Allow *List
+	Deny  *List
+	// TrustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers are used,
+	// the ones set by utils.SetTrustedProxies when nil
+	TrustedProxies *List
+	// Drop closes the connection of blocked requests instead of answering 403
+	Drop bool
+	// OnMatch is called with "allow" or "deny" and the CIDR matching a request,
+	// with an invalid prefix when the request was blocked by matching nothing in Allow
+	OnMatch func(list string, prefix netip.Prefix)
+}
+
+// Handler blocks the requests refused by policy before they're handled by h
+func Handler(h http.Handler, policy Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy.allowed(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if policy.Drop {
+			// Closes the connection, or resets the stream over HTTP/2, without a response
+			panic(http.ErrAbortHandler)
+		}
+		errpage.Write(w, r, http.StatusForbidden, "Access denied")
+	})
+}
+
+func (p Policy) allowed(r *http.Request) bool {
+	addr, ok := p.clientAddr(r)
+	if !ok {
+		return p.Allow == nil && p.Deny == nil
+	}
+	if p.Deny != nil {
+		if prefix, ok := p.Deny.Match(addr); ok {
+			p.hit("deny", prefix)
+			return false
+		}
+	}
+	if p.Allow != nil {
+		prefix, ok := p.Allow.Match(addr)
+		p.hit("allow", prefix)
+		return ok
+	}
+	return true
+}
+
+// clientAddr returns the client address of r, see utils.ClientAddr
+func (p Policy) clientAddr(r *http.Request) (netip.Addr, bool) {
+	return utils.ClientAddr(r, p.trusts)
+}
+
+// trusts reports whether addr is one of the route's trusted proxies, or of the proxies
+// trusted by the whole proxy when the route has none
+func (p Policy) trusts(addr netip.Addr) bool {
+	if p.TrustedProxies == nil {
+		return utils.TrustedProxy(addr)
+	}
+	_, ok := p.TrustedProxies.Match(addr)
+	return ok
+}
+
+func (p Policy) hit(list string, prefix netip.Prefix) {
+	if p.OnMatch != nil {
+		p.OnMatch(list, prefix)
+	}
+}
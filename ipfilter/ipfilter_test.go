@@ -0,0 +1,150 @@
+package ipfilter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList_Match(t *testing.T) {
+	l, err := NewList("10.0.0.0/8", "10.1.0.0/16", "192.0.2.7", "2001:db8::/32", "::ffff:172.16.0.0/108")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.2.3.4", want: "10.0.0.0/8"},
+		{ip: "10.1.3.4", want: "10.1.0.0/16"},
+		{ip: "192.0.2.7", want: "192.0.2.7/32"},
+		{ip: "192.0.2.8"},
+		{ip: "::ffff:10.1.0.1", want: "10.1.0.0/16"},
+		{ip: "172.16.5.5", want: "172.16.0.0/12"},
+		{ip: "2001:db8:1::1", want: "2001:db8::/32"},
+		{ip: "2001:db9::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			prefix, ok := l.Match(netip.MustParseAddr(tt.ip))
+			assert.Equal(t, tt.want != "", ok)
+			if ok {
+				assert.Equal(t, tt.want, prefix.String())
+			}
+		})
+	}
+
+	_, err = NewList("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = NewList("::ffff:0.0.0.0/64")
+	assert.Error(t, err, "an IPv4-mapped prefix needs the 96 bits of the mapping")
+}
+
+func TestHandler(t *testing.T) {
+	allow, err := NewList("10.0.0.0/8", "2001:db8::/32")
+	assert.NoError(t, err)
+	deny, err := NewList("10.6.6.0/24")
+	assert.NoError(t, err)
+	proxies, err := NewList("192.0.2.0/28")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		policy     Policy
+		remoteAddr string
+		header     http.Header
+		wantStatus int
+		wantHit    string
+	}{
+		{name: "allowed", policy: Policy{Allow: allow, Deny: deny}, remoteAddr: "10.1.1.1:1234", wantStatus: http.StatusOK, wantHit: "allow 10.0.0.0/8"},
+		{name: "allowed ipv6", policy: Policy{Allow: allow}, remoteAddr: "[2001:db8::1]:1234", wantStatus: http.StatusOK, wantHit: "allow 2001:db8::/32"},
+		{name: "denied", policy: Policy{Allow: allow, Deny: deny}, remoteAddr: "10.6.6.6:1234", wantStatus: http.StatusForbidden, wantHit: "deny 10.6.6.0/24"},
+		{name: "not allowed", policy: Policy{Allow: allow}, remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusForbidden, wantHit: "allow invalid Prefix"},
+		{name: "deny only", policy: Policy{Deny: deny}, remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusOK},
+		{name: "unparsable ip", policy: Policy{Deny: deny}, remoteAddr: "unknown", wantStatus: http.StatusForbidden},
+		{
+			name: "forged forwarding header", policy: Policy{Allow: allow, Deny: deny}, remoteAddr: "10.6.6.6:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.1.1.1"}, "X-Real-Ip": {"10.1.1.1"}},
+			wantStatus: http.StatusForbidden, wantHit: "deny 10.6.6.0/24",
+		},
+		{
+			name: "forged forwarding header, not allowed", policy: Policy{Allow: allow}, remoteAddr: "198.51.100.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.1.1.1"}},
+			wantStatus: http.StatusForbidden, wantHit: "allow invalid Prefix",
+		},
+		{
+			name: "trusted proxy", policy: Policy{Allow: allow, Deny: deny, TrustedProxies: proxies}, remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.6.6.6"}},
+			wantStatus: http.StatusForbidden, wantHit: "deny 10.6.6.0/24",
+		},
+		{
+			name: "trusted proxies chain", policy: Policy{Allow: allow, Deny: deny, TrustedProxies: proxies}, remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.1.1.1, 10.6.6.6", "192.0.2.2"}},
+			wantStatus: http.StatusForbidden, wantHit: "deny 10.6.6.0/24",
+		},
+		{
+			name: "trusted proxy real ip", policy: Policy{Allow: allow, TrustedProxies: proxies}, remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Real-Ip": {"10.1.1.1"}},
+			wantStatus: http.StatusOK, wantHit: "allow 10.0.0.0/8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hit string
+			tt.policy.OnMatch = func(list string, prefix netip.Prefix) { hit = list + " " + prefix.String() }
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), tt.policy)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, vs := range tt.header {
+				r.Header[k] = vs
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantHit, hit)
+		})
+	}
+}
+
+func TestHandler_drop(t *testing.T) {
+	deny, err := NewList("127.0.0.1")
+	assert.NoError(t, err)
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), Policy{Deny: deny, Drop: true}))
+	defer server.Close()
+
+	_, err = http.Get(server.URL)
+	assert.Error(t, err, "the connection is closed without a response")
+}
+
+func TestList_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("# abusive\n10.0.0.0/8\n"), 0o644))
+	l, err := LoadList(path)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Watch(ctx, 5*time.Millisecond)
+
+	_, ok := l.Match(netip.MustParseAddr("192.0.2.1"))
+	assert.False(t, ok)
+
+	// An invalid file keeps the list
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte("192.0.2.0/33\n"), 0o644))
+	time.Sleep(20 * time.Millisecond)
+	_, ok = l.Match(netip.MustParseAddr("10.0.0.1"))
+	assert.True(t, ok)
+
+	assert.NoError(t, os.WriteFile(path, []byte("10.0.0.0/8\n192.0.2.0/24 # new\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		_, ok := l.Match(netip.MustParseAddr("192.0.2.1"))
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
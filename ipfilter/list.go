@@ -0,0 +1,128 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// List is a set of IPv4 and IPv6 CIDRs, loaded from a file that's read again when it changes
+type List struct {
+	Path string
+	tree atomic.Pointer[tree]
+}
+
+// LoadList reads the file at path, it holds a CIDR or an IP address per line and # comments
+func LoadList(path string) (*List, error) {
+	l := &List{Path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewList returns a list of the given CIDRs or IP addresses
+func NewList(cidrs ...string) (*List, error) {
+	t, err := parse(strings.NewReader(strings.Join(cidrs, "\n")), "list")
+	if err != nil {
+		return nil, err
+	}
+	l := &List{}
+	l.tree.Store(t)
+	return l, nil
+}
+
+// Reload reads the file again, the list is left as it is when the file is invalid
+func (l *List) Reload() error {
+	b, err := os.ReadFile(l.Path)
+	if err != nil {
+		return err
+	}
+	t, err := parse(bytes.NewReader(b), l.Path)
+	if err != nil {
+		return err
+	}
+	l.tree.Store(t)
+	return nil
+}
+
+// Watch reloads the list when its file changes, until ctx is done
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	var modTime time.Time
+	if info, err := os.Stat(l.Path); err == nil {
+		modTime = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(l.Path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		if err := l.Reload(); err != nil {
+			log.Printf("ipfilter: %v", err)
+			continue
+		}
+		modTime = info.ModTime()
+		log.Printf("ipfilter: reloaded %s", l.Path)
+	}
+}
+
+// Match returns the most specific CIDR of the list holding addr
+func (l *List) Match(addr netip.Addr) (netip.Prefix, bool) {
+	return l.tree.Load().match(addr)
+}
+
+func parse(r io.Reader, name string) (*tree, error) {
+	t := &tree{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		prefix, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		t.insert(prefix)
+	}
+	return t, scanner.Err()
+}
+
+// parsePrefix parses a CIDR, or an IP address as a single address CIDR
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("%s: IPv4-mapped prefix shorter than 96 bits", s)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix, nil
+}
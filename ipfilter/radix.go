@@ -0,0 +1,60 @@
+package ipfilter
+
+import "net/netip"
+
+// tree is a binary radix tree of prefixes, one bit of the address per level.
+// IPv4 and IPv6 prefixes are kept in separate trees.
+type tree struct {
+	v4, v6 node
+}
+
+type node struct {
+	children [2]*node
+	prefix   *netip.Prefix // set when a prefix ends at this node
+}
+
+func (t *tree) insert(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	n := t.root(prefix.Addr())
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bit(bytes, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	n.prefix = &prefix
+}
+
+// match returns the most specific prefix holding addr
+func (t *tree) match(addr netip.Addr) (netip.Prefix, bool) {
+	addr = addr.Unmap()
+	n := t.root(addr)
+	bytes := addr.AsSlice()
+	var found *netip.Prefix
+	for i := 0; n != nil; i++ {
+		if n.prefix != nil {
+			found = n.prefix
+		}
+		if i == len(bytes)*8 {
+			break
+		}
+		n = n.children[bit(bytes, i)]
+	}
+	if found == nil {
+		return netip.Prefix{}, false
+	}
+	return *found, true
+}
+
+func (t *tree) root(addr netip.Addr) *node {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func bit(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Stream the server date time as Server-Sent Events, one event per second.
+// The ?silence=10s parameter pauses the stream after the first event to test heartbeats.
+func eventsEndpoint(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	silence, _ := time.ParseDuration(r.URL.Query().Get("silence"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	log.Printf("Client %s Connected\n", r.RemoteAddr)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for id := 1; ; id++ {
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: date\ndata: %s\n\n", id, time.Now().Format(time.RFC850)); err != nil {
+			log.Println(err)
+			return
+		}
+		flusher.Flush()
+
+		wait := ticker.C
+		if id == 1 && silence > 0 {
+			wait = time.After(silence)
+		}
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			log.Printf("Client %s Disconnected\n", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+// Long polling: answer after the given ?wait=5s delay without any Content-Length,
+// writing the body in chunks
+func pollEndpoint(w http.ResponseWriter, r *http.Request) {
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		wait = 5 * time.Second
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	for i := 0; i < 3; i++ {
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprintf(w, "{\"chunk\": %d, \"date\": %q}\n", i, time.Now().Format(time.RFC850))
+		w.(http.Flusher).Flush()
+	}
+}
+
+func main() {
+	http.HandleFunc("/events", eventsEndpoint)
+	http.HandleFunc("/poll", pollEndpoint)
+
+	host := os.Args[1]
+	log.Printf("Origin started at %s\n", host)
+	log.Fatal(http.ListenAndServe(host, nil))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"proxy/requestid"
+	"proxy/utils"
+)
+
+// accessLog writes a line per request handled by h to out once it's answered:
+// client IP, method, path, protocol, status, response bytes, duration and request ID
+func accessLog(h http.Handler, out io.Writer) http.Handler {
+	logger := log.New(out, "", log.LstdFlags)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		cw := &countingWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		defer func() {
+			status := cw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			logger.Printf("%s %q %s %d %d %s %s", utils.GetRemoteIP(r), r.Method+" "+r.URL.RequestURI(), r.Proto,
+				status, cw.bytes, time.Since(start).Round(time.Microsecond), requestid.Get(r))
+		}()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// countingWriter captures the status and counts the body bytes of a response
+type countingWriter struct {
+	statusWriter
+	bytes int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.statusWriter.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
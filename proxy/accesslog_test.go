@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/requestid"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	h := requestid.Handler(accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}), &out))
+
+	r := httptest.NewRequest(http.MethodPost, "/items?a=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set(requestid.Header, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Contains(t, out.String(), `192.0.2.1 "POST /items?a=1" HTTP/1.1 201 5 `)
+	assert.Contains(t, out.String(), " req-1\n")
+}
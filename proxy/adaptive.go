@@ -0,0 +1,85 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"proxy/adaptive"
+	"proxy/errpage"
+	"proxy/timeout"
+)
+
+// admit lets a request through the adaptive concurrency limit of the pool, if it has one.
+// The returned writer measures the latency to the response headers, done reports it to
+// the limiter once the response is over.
+func (s *ServerPool) admit(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	if s.limiter == nil {
+		return w, func() {}, true
+	}
+	release, ok := s.limiter.Acquire()
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		errpage.Write(w, r, http.StatusServiceUnavailable, "Origin servers overloaded")
+		return nil, nil, false
+	}
+	lw := &latencyWriter{statusWriter: statusWriter{ResponseWriter: w}, start: time.Now()}
+	upgrade := r.Header.Get("Upgrade") != ""
+	return lw, func() {
+		release(lw.latency, lw.outcome(upgrade))
+	}, true
+}
+
+// latencyWriter records the time until the response headers are written
+type latencyWriter struct {
+	statusWriter
+	start   time.Time
+	latency time.Duration
+}
+
+func (l *latencyWriter) WriteHeader(status int) {
+	if l.latency == 0 {
+		l.latency = time.Since(l.start)
+	}
+	l.statusWriter.WriteHeader(status)
+}
+
+func (l *latencyWriter) Write(p []byte) (int, error) {
+	if l.latency == 0 {
+		l.latency = time.Since(l.start)
+	}
+	return l.statusWriter.Write(p)
+}
+
+// outcome classifies the response for the limiter. Streams and upgraded connections last
+// as long as the client wants, and requests without response say nothing of the upstream.
+func (l *latencyWriter) outcome(upgrade bool) adaptive.Outcome {
+	if l.status == 0 || upgrade {
+		return adaptive.Ignore
+	}
+	switch {
+	case timeout.IsStreamingType(l.Header().Get("Content-Type")):
+		return adaptive.Ignore
+	case l.status >= 500:
+		return adaptive.Failure
+	}
+	return adaptive.Success
+}
+
+// publishLimits adds the adaptive concurrency limit of every pool to the metrics
+func publishLimits(serverPools pools) {
+	expvar.Publish("adaptive", expvar.Func(func() any {
+		state := map[string]map[string]any{}
+		for name, pool := range serverPools {
+			if pool.limiter == nil {
+				continue
+			}
+			state[name] = map[string]any{
+				"limit":     pool.limiter.Limit(),
+				"in_flight": pool.limiter.InFlight(),
+				"shed":      pool.limiter.Shed(),
+			}
+		}
+		return state
+	}))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/adaptive"
+)
+
+func TestServerPool_admit(t *testing.T) {
+	pool := &ServerPool{limiter: adaptive.New(adaptive.Options{InitialLimit: 1, MinLimit: 1, MaxLimit: 1})}
+
+	w, done, ok := pool.admit(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.True(t, ok)
+	assert.Equal(t, 1, pool.limiter.InFlight())
+
+	rejected := httptest.NewRecorder()
+	_, _, ok = pool.admit(rejected, httptest.NewRequest("GET", "/", nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	assert.Equal(t, "1", rejected.Header().Get("Retry-After"))
+	assert.Equal(t, int64(1), pool.limiter.Shed())
+
+	w.WriteHeader(http.StatusOK)
+	done()
+	assert.Zero(t, pool.limiter.InFlight())
+}
+
+func TestLatencyWriter_outcome(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		upgrade     bool
+		want        adaptive.Outcome
+	}{
+		{name: "success", status: http.StatusOK, contentType: "text/html", want: adaptive.Success},
+		{name: "client error", status: http.StatusNotFound, want: adaptive.Success},
+		{name: "server error", status: http.StatusBadGateway, want: adaptive.Failure},
+		{name: "no response", want: adaptive.Ignore},
+		{name: "event stream", status: http.StatusOK, contentType: "text/event-stream; charset=utf-8", want: adaptive.Ignore},
+		{name: "upgrade", status: http.StatusOK, upgrade: true, want: adaptive.Ignore},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := &latencyWriter{statusWriter: statusWriter{ResponseWriter: httptest.NewRecorder()}}
+			if test.contentType != "" {
+				l.Header().Set("Content-Type", test.contentType)
+			}
+			if test.status != 0 {
+				l.WriteHeader(test.status)
+			}
+			assert.Equal(t, test.want, l.outcome(test.upgrade))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"proxy/cache"
+	"proxy/fault"
+)
+
+// writeJSON writes v as the JSON body of an admin API response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin: could not write response: %v", err)
+	}
+}
+
+// registerCacheAdmin adds the cache purge endpoint to the admin API.
+//
+//	POST /cache/purge?url=http://127.0.0.1:9090/get  purges one URL and all its variants
+//	POST /cache/purge?prefix=127.0.0.1:9090/api/     purges every URL starting with prefix
+func registerCacheAdmin(mux *http.ServeMux, c *cache.Cache) {
+	mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		var purged int
+		query := r.URL.Query()
+		switch {
+		case query.Has("url"):
+			u, err := url.Parse(query.Get("url"))
+			if err != nil || u.Host == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid url"})
+				return
+			}
+			purged = c.Purge(u)
+		case query.Has("prefix"):
+			purged = c.PurgePrefix(query.Get("prefix"))
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing url or prefix parameter"})
+			return
+		}
+		log.Printf("admin: purged %d cache entries", purged)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	})
+}
+
+// registerSplitAdmin adds the canary split endpoints to the admin API.
+//
+//	GET  /split                        lists the splits with their percentage and stats
+//	POST /split?route=api&percent=25   sets the canary percentage, resuming an aborted split
+func registerSplitAdmin(mux *http.ServeMux, splitters map[string]*splitter) {
+	mux.HandleFunc("/split", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			statuses := []map[string]any{}
+			for _, s := range splitters {
+				statuses = append(statuses, s.status())
+			}
+			writeJSON(w, http.StatusOK, statuses)
+		case http.MethodPost:
+			s, ok := splitters[r.URL.Query().Get("route")]
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown route"})
+				return
+			}
+			percent, err := strconv.ParseFloat(r.URL.Query().Get("percent"), 64)
+			if err != nil || percent < 0 || percent > 100 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "percent must be between 0 and 100"})
+				return
+			}
+			s.resume(percent)
+			writeJSON(w, http.StatusOK, s.status())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+}
+
+// registerFaultAdmin adds the fault injection endpoints to the admin API, faults are off
+// until set.
+//
+//	GET    /faults                  lists the fault policies by route
+//	PUT    /faults?route=api        sets the fault policy of a route from the JSON body
+//	DELETE /faults?route=api        stops injecting faults into a route
+func registerFaultAdmin(mux *http.ServeMux, injectors map[string]*fault.Injector) {
+	mux.HandleFunc("/faults", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			policies := map[string]*fault.Policy{}
+			for route, i := range injectors {
+				policies[route] = i.Policy()
+			}
+			writeJSON(w, http.StatusOK, policies)
+			return
+		}
+
+		i, ok := injectors[r.URL.Query().Get("route")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown route"})
+			return
+		}
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			policy := &fault.Policy{}
+			if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := policy.Validate(); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			i.Set(policy)
+			log.Printf("admin: fault injection set on route %s", r.URL.Query().Get("route"))
+			writeJSON(w, http.StatusOK, policy)
+		case http.MethodDelete:
+			i.Set(nil)
+			log.Printf("admin: fault injection stopped on route %s", r.URL.Query().Get("route"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"proxy/auth"
+	"proxy/body"
+	"proxy/discovery"
+	"proxy/ipfilter"
+	"proxy/ratelimit"
+	"proxy/ratelimit/fixed_window"
+	"proxy/ratelimit/sliding_log"
+	"proxy/ratelimit/sliding_window"
+	"proxy/ratelimit/token_bucket"
+	"proxy/rewrite"
+	"proxy/timeout"
+	"proxy/utils"
+)
+
+// Config is the content of the JSON file given with --config
+type Config struct {
+	// Pools are named server pools in addition to "default", given with --servers,
+	// and "shadow", given with --shadow-servers
+	Pools map[string][]string `json:"pools"`
+	// Discovery finds the servers of pools, "default" included, instead of listing them
+	Discovery map[string]*DiscoveryConfig `json:"discovery"`
+	// Timeouts apply to the routes without their own timeouts
+	Timeouts *TimeoutConfig `json:"timeouts"`
+	Routes   []RouteConfig  `json:"routes"`
+}
+
+// RouteConfig holds the settings of the requests whose path starts with PathPrefix
+type RouteConfig struct {
+	Name       string           `json:"name"`
+	PathPrefix string           `json:"path_prefix"`
+	Pool       string           `json:"pool"` // defaults to "default"
+	Rewrite    rewrite.Rules    `json:"rewrite"`
+	Mirror     *MirrorConfig    `json:"mirror"`
+	Split      *SplitConfig     `json:"split"`
+	Timeouts   *TimeoutConfig   `json:"timeouts"`
+	Body       *BodyConfig      `json:"body"`
+	Auth       *AuthConfig      `json:"auth"`
+	IPFilter   *IPFilterConfig  `json:"ip_filter"`
+	Hedge      *HedgeConfig     `json:"hedge"`
+	Shedding   *ShedConfig      `json:"shedding"`
+	RateLimit  *RateLimitConfig `json:"rate_limit"`
+}
+
+// DiscoveryConfig sets where the servers of a pool are found, only one provider can be set
+type DiscoveryConfig struct {
+	Static []string             `json:"static"`
+	File   *FileDiscoveryConfig `json:"file"`
+	DNS    *DNSDiscoveryConfig  `json:"dns"`
+}
+
+// FileDiscoveryConfig reads the servers from a JSON or YAML file, see discovery.File
+type FileDiscoveryConfig struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+}
+
+// DNSDiscoveryConfig resolves the servers from A, AAAA or SRV records, see discovery.DNS
+type DNSDiscoveryConfig struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Scheme      string   `json:"scheme"`
+	Port        int      `json:"port"`
+	Resolver    string   `json:"resolver"`
+	MinInterval Duration `json:"min_interval"`
+	MaxInterval Duration `json:"max_interval"`
+}
+
+func (d *DiscoveryConfig) provider() (discovery.Provider, error) {
+	var providers []discovery.Provider
+	if len(d.Static) > 0 {
+		providers = append(providers, discovery.Static(d.Static))
+	}
+	if d.File != nil {
+		providers = append(providers, &discovery.File{Path: d.File.Path, Interval: d.File.Interval.Duration})
+	}
+	if d.DNS != nil {
+		providers = append(providers, &discovery.DNS{
+			Name:        d.DNS.Name,
+			Type:        d.DNS.Type,
+			Scheme:      d.DNS.Scheme,
+			Port:        d.DNS.Port,
+			Resolver:    d.DNS.Resolver,
+			MinInterval: d.DNS.MinInterval.Duration,
+			MaxInterval: d.DNS.MaxInterval.Duration,
+		})
+	}
+	if len(providers) != 1 {
+		return nil, errors.New("exactly one of static, file and dns must be set")
+	}
+	return providers[0], nil
+}
+
+// HedgeConfig sends a second copy of the GET and HEAD requests of a route to another server
+// when they wait longer than Percentile of the recent latencies, or MinDelay. The hedges
+// are at most BudgetPercent of the requests.
+type HedgeConfig struct {
+	Percentile    float64  `json:"percentile"`     // defaults to 95
+	MinDelay      Duration `json:"min_delay"`      // delay before hedging when the percentile is lower
+	BudgetPercent float64  `json:"budget_percent"` // defaults to 10
+}
+
+// IPFilterConfig blocks the requests from the client IPs in the Deny file, or not in the
+// Allow file. The files hold a CIDR or IP address per line and are reloaded when they change.
+// The client IP is the connection's, or the forwarded one when it comes from TrustedProxies,
+// the --trusted-proxies ones when unset.
+type IPFilterConfig struct {
+	Allow          string   `json:"allow"`
+	Deny           string   `json:"deny"`
+	Action         string   `json:"action"`          // "forbid" to answer 403, the default, or "drop" to close the connection
+	TrustedProxies []string `json:"trusted_proxies"` // CIDRs of the proxies whose X-Forwarded-For is used
+}
+
+func (f *IPFilterConfig) policy() (ipfilter.Policy, error) {
+	p := ipfilter.Policy{}
+	switch f.Action {
+	case "", "forbid":
+	case "drop":
+		p.Drop = true
+	default:
+		return p, fmt.Errorf("invalid action %q", f.Action)
+	}
+	var err error
+	if f.Allow != "" {
+		if p.Allow, err = ipfilter.LoadList(f.Allow); err != nil {
+			return p, err
+		}
+	}
+	if f.Deny != "" {
+		if p.Deny, err = ipfilter.LoadList(f.Deny); err != nil {
+			return p, err
+		}
+	}
+	if len(f.TrustedProxies) > 0 {
+		if p.TrustedProxies, err = ipfilter.NewList(f.TrustedProxies...); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// rateLimiters are the rate limiting algorithms selectable by name, they allow limit requests per window
+var rateLimiters = map[string]func(limit int64, window time.Duration) ratelimit.Limiter{
+	"fixed_window":   fixed_window.New,
+	"sliding_window": sliding_window.New,
+	"sliding_log": func(limit int64, window time.Duration) ratelimit.Limiter {
+		return sliding_log.NewSlidingLogLimiter(window, int(limit))
+	},
+	"token_bucket": func(limit int64, window time.Duration) ratelimit.Limiter {
+		return token_bucket.New(limit, window)
+	},
+}
+
+// RateLimitConfig allows Limit requests per Window to each client of a route
+type RateLimitConfig struct {
+	Algorithm string   `json:"algorithm"` // fixed_window, sliding_window, sliding_log or token_bucket, defaults to sliding_window
+	Limit     int64    `json:"limit"`
+	Window    Duration `json:"window"` // defaults to 1s
+	// Key identifies the clients: "ip", "header:<name>" falling back to the IP when the
+	// header is missing, or by default the authenticated identity or else the IP
+	Key string `json:"key"`
+	// Align starts the fixed_window windows on the "clock", the default, or on the "first_request" of a client
+	Align string `json:"align"`
+	// LegacyHeaders adds X-RateLimit-* headers to the standard RateLimit-* ones
+	LegacyHeaders bool `json:"legacy_headers"`
+	// Redis shares the sliding_window counters between the proxies using the same server
+	Redis *RedisConfig `json:"redis"`
+	// FailClosed rejects the requests when the limiter fails, such as when Redis is
+	// unreachable, instead of letting them through
+	FailClosed bool `json:"fail_closed"`
+}
+
+// RedisConfig is the Redis server of a rate limit, see sliding_window.RedisOptions
+type RedisConfig struct {
+	Address   string   `json:"address"`
+	Password  string   `json:"password"`
+	DB        int      `json:"db"`
+	KeyPrefix string   `json:"key_prefix"`
+	Timeout   Duration `json:"timeout"`
+}
+
+func (c *RateLimitConfig) limiter() (ratelimit.Limiter, error) {
+	algorithm := c.Algorithm
+	if algorithm == "" {
+		algorithm = "sliding_window"
+	}
+	newLimiter, ok := rateLimiters[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", c.Algorithm)
+	}
+	if c.Limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	window := c.Window.Duration
+	if window <= 0 {
+		window = time.Second
+	}
+	if c.Align != "" {
+		if algorithm != "fixed_window" {
+			return nil, fmt.Errorf("align isn't supported by %s", algorithm)
+		}
+		options := fixed_window.Options{Limit: c.Limit, Window: window}
+		switch c.Align {
+		case "clock":
+		case "first_request":
+			options.Align = fixed_window.AlignFirstRequest
+		default:
+			return nil, fmt.Errorf("invalid align %q", c.Align)
+		}
+		return fixed_window.NewLimiter(options), nil
+	}
+	if c.Redis != nil {
+		if algorithm != "sliding_window" {
+			return nil, fmt.Errorf("redis isn't supported by %s", algorithm)
+		}
+		return sliding_window.NewRedis(c.Limit, window, sliding_window.RedisOptions{
+			Addr:      c.Redis.Address,
+			Password:  c.Redis.Password,
+			DB:        c.Redis.DB,
+			KeyPrefix: c.Redis.KeyPrefix,
+			Timeout:   c.Redis.Timeout.Duration,
+		}), nil
+	}
+	return newLimiter(c.Limit, window), nil
+}
+
+// key returns the key extractor of the rate limit
+func (c *RateLimitConfig) key() (func(r *http.Request) string, error) {
+	if name, ok := strings.CutPrefix(c.Key, "header:"); ok && name != "" {
+		return func(r *http.Request) string {
+			if value := r.Header.Get(name); value != "" {
+				return "header:" + value
+			}
+			return utils.GetRemoteIP(r)
+		}, nil
+	}
+	switch c.Key {
+	case "":
+		return auth.Key, nil
+	case "ip":
+		return utils.GetRemoteIP, nil
+	}
+	return nil, fmt.Errorf("invalid key %q", c.Key)
+}
+
+// AuthConfig authenticates the requests of a route with the first method finding credentials
+type AuthConfig struct {
+	APIKeys  *APIKeysConfig `json:"api_keys"`
+	Htpasswd string         `json:"htpasswd"` // file of bcrypt hashes for Basic auth
+	Realm    string         `json:"realm"`
+	JWT      *JWTConfig     `json:"jwt"`
+	// Optional lets the requests without credentials through
+	Optional bool `json:"optional"`
+	// ClaimHeaders forwards JWT claims upstream, from claim name to header name
+	ClaimHeaders map[string]string `json:"claim_headers"`
+}
+
+// APIKeysConfig maps static API keys to the subject they authenticate
+type APIKeysConfig struct {
+	Header string            `json:"header"`
+	Query  string            `json:"query"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// JWTConfig verifies bearer tokens with the keys of a JWKS file
+type JWTConfig struct {
+	JWKS     string   `json:"jwks"`
+	Audience string   `json:"audience"`
+	Leeway   Duration `json:"leeway"`
+}
+
+func (a *AuthConfig) policy() (auth.Policy, error) {
+	p := auth.Policy{Optional: a.Optional, ClaimHeaders: a.ClaimHeaders}
+	if a.APIKeys != nil {
+		p.Authenticators = append(p.Authenticators, auth.NewAPIKeys(a.APIKeys.Header, a.APIKeys.Query, a.APIKeys.Keys))
+	}
+	if a.Htpasswd != "" {
+		basic, err := auth.LoadHtpasswd(a.Htpasswd, a.Realm)
+		if err != nil {
+			return p, err
+		}
+		p.Authenticators = append(p.Authenticators, basic)
+	}
+	if a.JWT != nil {
+		jwt, err := auth.LoadJWT(a.JWT.JWKS, a.JWT.Audience, a.JWT.Leeway.Duration)
+		if err != nil {
+			return p, err
+		}
+		p.Authenticators = append(p.Authenticators, jwt)
+	}
+	if len(p.Authenticators) == 0 {
+		return p, errors.New("no authentication method")
+	}
+	return p, nil
+}
+
+// BodyConfig is the request body policy of a route, see body.Policy
+type BodyConfig struct {
+	MaxBytes     int64    `json:"max_bytes"`
+	Buffer       bool     `json:"buffer"`
+	MemoryBytes  int64    `json:"memory_bytes"` // defaults to 1MB
+	TempDir      string   `json:"temp_dir"`
+	MinRate      int64    `json:"min_rate"` // bytes per second
+	MinRateGrace Duration `json:"min_rate_grace"`
+}
+
+func (b *BodyConfig) policy() body.Policy {
+	p := body.Policy{
+		MaxBytes:     b.MaxBytes,
+		Buffer:       b.Buffer,
+		MemoryBytes:  b.MemoryBytes,
+		TempDir:      b.TempDir,
+		MinRate:      b.MinRate,
+		MinRateGrace: b.MinRateGrace.Duration,
+	}
+	if p.MemoryBytes <= 0 {
+		p.MemoryBytes = 1 << 20
+	}
+	return p
+}
+
+// TimeoutConfig is the timeout policy of a route, see timeout.Policy
+type TimeoutConfig struct {
+	// HeaderRead is the time clients have to send the request header. The route is only
+	// known once the header is read, so it's set for all of them in the top-level timeouts.
+	HeaderRead     Duration `json:"header_read"`
+	Request        Duration `json:"request"`
+	BodyIdle       Duration `json:"body_idle"`
+	ResponseHeader Duration `json:"response_header"`
+	StreamIdle     Duration `json:"stream_idle"`
+	Streaming      bool     `json:"streaming"`
+}
+
+// defaultTimeouts is used when the config file sets no timeouts
+var defaultTimeouts = TimeoutConfig{
+	HeaderRead:     Duration{Duration: 2 * time.Second},
+	ResponseHeader: Duration{Duration: 2 * time.Second},
+}
+
+// headerReadTimeout is the time clients have to send the request header, on every route
+func (c *Config) headerReadTimeout() time.Duration {
+	if c.Timeouts != nil && c.Timeouts.HeaderRead.Duration > 0 {
+		return c.Timeouts.HeaderRead.Duration
+	}
+	return defaultTimeouts.HeaderRead.Duration
+}
+
+func (t *TimeoutConfig) policy() timeout.Policy {
+	return timeout.Policy{
+		Request:        t.Request.Duration,
+		BodyIdle:       t.BodyIdle.Duration,
+		ResponseHeader: t.ResponseHeader.Duration,
+		StreamIdle:     t.StreamIdle.Duration,
+		Streaming:      t.Streaming,
+	}
+}
+
+// MirrorConfig copies Percent of the route's requests to the shadow servers, or to Pool when set.
+// Requests with a body larger than MaxBodyBytes, 1MiB by default, are not mirrored.
+type MirrorConfig struct {
+	Pool         string   `json:"pool"`
+	Percent      float64  `json:"percent"`
+	MaxBodyBytes int64    `json:"max_body_bytes"`
+	Timeout      Duration `json:"timeout"`
+}
+
+// SplitConfig sends Percent of the route's clients, and the requests matching Header
+// or Cookie, to the canary Pool instead of the route's pool.
+type SplitConfig struct {
+	Pool    string       `json:"pool"`
+	Percent float64      `json:"percent"`
+	Header  *MatchConfig `json:"header"`
+	Cookie  *MatchConfig `json:"cookie"`
+	Abort   *AbortConfig `json:"abort"`
+}
+
+// MatchConfig matches a header or cookie by name, and by value unless Value is empty
+type MatchConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// AbortConfig stops a split once, within Window and after MinRequests canary requests,
+// the canary's 5xx rate exceeds the stable one by more than MaxErrorRateDelta (0.05 is 5 points).
+type AbortConfig struct {
+	MaxErrorRateDelta float64  `json:"max_error_rate_delta"`
+	MinRequests       int64    `json:"min_requests"`
+	Window            Duration `json:"window"`
+}
+
+// Duration is a time.Duration written as a string such as "1.5s" in the config file
+type Duration = utils.Duration
+
+func loadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", file, err)
+	}
+	return config, nil
+}
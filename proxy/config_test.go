@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/ratelimit/fixed_window"
+	"proxy/ratelimit/sliding_log"
+	"proxy/ratelimit/token_bucket"
+)
+
+func TestRateLimitConfig_limiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RateLimitConfig
+		want    any
+		wantErr bool
+	}{
+		{name: "default algorithm", config: RateLimitConfig{Limit: 10}},
+		{name: "fixed window", config: RateLimitConfig{Algorithm: "fixed_window", Limit: 10}, want: &fixed_window.Limiter{}},
+		{name: "sliding log", config: RateLimitConfig{Algorithm: "sliding_log", Limit: 10}, want: &sliding_log.SlidingLogLimiter{}},
+		{name: "token bucket", config: RateLimitConfig{Algorithm: "token_bucket", Limit: 10}, want: &token_bucket.Limiter{}},
+		{name: "redis", config: RateLimitConfig{Limit: 10, Redis: &RedisConfig{Address: "127.0.0.1:6379"}}},
+		{name: "redis with token bucket", config: RateLimitConfig{Algorithm: "token_bucket", Limit: 10, Redis: &RedisConfig{}}, wantErr: true},
+		{name: "fixed window aligned on the first request", config: RateLimitConfig{Algorithm: "fixed_window", Limit: 10, Align: "first_request"}, want: &fixed_window.Limiter{}},
+		{name: "invalid align", config: RateLimitConfig{Algorithm: "fixed_window", Limit: 10, Align: "hour"}, wantErr: true},
+		{name: "align with sliding log", config: RateLimitConfig{Algorithm: "sliding_log", Limit: 10, Align: "clock"}, wantErr: true},
+		{name: "unknown algorithm", config: RateLimitConfig{Algorithm: "leaky_bucket", Limit: 10}, wantErr: true},
+		{name: "no limit", config: RateLimitConfig{}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter, err := test.config.limiter()
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, limiter)
+			if test.want != nil {
+				assert.IsType(t, test.want, limiter)
+			}
+		})
+	}
+}
+
+func TestRateLimitConfig_key(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: "192.0.2.1"},
+		{name: "ip", key: "ip", header: "k1", want: "192.0.2.1"},
+		{name: "header", key: "header:X-API-Key", header: "k1", want: "header:k1"},
+		{name: "missing header", key: "header:X-API-Key", want: "192.0.2.1"},
+		{name: "no header name", key: "header:", wantErr: true},
+		{name: "invalid", key: "cookie", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := (&RateLimitConfig{Key: test.key}).key()
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if test.header != "" {
+				r.Header.Set("X-API-Key", test.header)
+			}
+			assert.Equal(t, test.want, key(r))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"proxy/discovery"
+)
+
+// discoveryTimeout is how long the proxy waits at startup for the servers of a discovered pool
+const discoveryTimeout = 10 * time.Second
+
+// SetServers makes urls the servers of the pool. The servers already in the pool are kept
+// as they are, with their health, queue and counters, the new ones start slowly. Invalid
+// URLs are logged and skipped.
+func (s *ServerPool) SetServers(urls []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current := make(map[string]*Server, len(s.servers))
+	for _, server := range s.servers {
+		current[server.Url.String()] = server
+	}
+	servers := make([]*Server, 0, len(urls))
+	for _, u := range urls {
+		server, ok := current[u]
+		if ok {
+			delete(current, u)
+		} else {
+			var err error
+			if server, err = newServer(u); err != nil {
+				// The running proxy keeps going with the valid servers
+				log.Printf("Server %s skipped: %v", u, err)
+				continue
+			}
+			server.startSlowly(s.slowStart)
+			log.Printf("Server %s added", u)
+		}
+		servers = append(servers, server)
+	}
+	for u := range current {
+		log.Printf("Server %s removed", u)
+	}
+	s.servers = servers
+}
+
+// SetSlowStart sets the slow start of the servers added or recovering from now on
+func (s *ServerPool) SetSlowStart(slowStart slowStart) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.slowStart = slowStart
+}
+
+// discover keeps the servers of the pool up to date with the provider,
+// it returns once the first servers are known.
+func (s *ServerPool) discover(provider discovery.Provider) error {
+	first := make(chan struct{})
+	go provider.Watch(context.Background(), func(urls []string) {
+		s.SetServers(urls)
+		select {
+		case <-first:
+		default:
+			close(first)
+		}
+	})
+
+	select {
+	case <-first:
+		return nil
+	case <-time.After(discoveryTimeout):
+		return fmt.Errorf("no servers discovered after %s", discoveryTimeout)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/discovery"
+)
+
+func TestServerPool_SetServers(t *testing.T) {
+	pool := &ServerPool{index: -1}
+	assert.NoError(t, pool.discover(discovery.Static{"http://127.0.0.1:8081", "http://127.0.0.1:8082"}))
+	assert.Len(t, pool.Servers(), 2)
+	kept := pool.Servers()[1]
+	kept.SetAlive(false, pool.slowStart)
+	assert.Equal(t, 1.0, pool.Servers()[0].weight(pool.slowStart), "the first servers don't start slowly")
+
+	pool.SetSlowStart(slowStart{Duration: time.Hour})
+	pool.SetServers([]string{"http://127.0.0.1:8082", "http://127.0.0.1:8083"})
+	servers := pool.Servers()
+	if assert.Len(t, servers, 2) {
+		assert.Same(t, kept, servers[0], "unchanged servers are kept with their state")
+		assert.False(t, servers[0].IsAlive())
+		assert.Equal(t, "127.0.0.1:8083", servers[1].Url.Host)
+		assert.Less(t, servers[1].weight(pool.slowStart), 0.1, "new servers start slowly")
+	}
+
+	// An invalid server is skipped, the running proxy keeps the others
+	pool.SetServers([]string{"http://127.0.0.1:8082", "unix://"})
+	assert.Equal(t, []*Server{kept}, pool.Servers())
+}
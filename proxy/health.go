@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthCheck probes the servers of the pool every interval, marking them down or alive.
+// Servers are probed with a GET on path when it's set, with a TCP connection otherwise.
+func (s *ServerPool) healthCheck(interval time.Duration, path string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, server := range s.Servers() {
+			go func(server *Server) {
+				err := server.probe(path, interval)
+				server.SetAlive(err == nil, s.slowStart)
+				if err != nil {
+					healthMetrics.Add(server.address+".failures", 1)
+				}
+			}(server)
+		}
+	}
+}
+
+// probe checks the server once, it returns the reason why the server is considered down
+func (s *Server) probe(path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if path == "" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, s.network, s.address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	u := *s.target
+	u.Path = path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.Reverse.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeWindowSize = 512 // latencies the percentile is computed from
+	hedgeMinSamples = 20  // latencies needed before hedging
+	hedgeBudgetMax  = 10  // hedges that can be saved up for a burst
+)
+
+var errHedgeLost = errors.New("another copy of the request answered first")
+
+// hedger sends a second copy of a slow idempotent request to another server of its pool,
+// once the request has waited for a percentile of the recent latencies. The first response
+// wins and the other request is cancelled. Hedges are paid with a budget filled by every
+// request, so they add at most BudgetPercent of load.
+type hedger struct {
+	route     string
+	config    HedgeConfig
+	latencies *latencyWindow
+	budget    *hedgeBudget
+}
+
+func newHedger(route string, config *HedgeConfig) *hedger {
+	c := *config
+	if c.Percentile <= 0 || c.Percentile >= 100 {
+		c.Percentile = 95
+	}
+	if c.BudgetPercent <= 0 {
+		c.BudgetPercent = 10
+	}
+	return &hedger{
+		route:     route,
+		config:    c,
+		latencies: &latencyWindow{percentile: c.Percentile},
+		budget:    &hedgeBudget{ratio: c.BudgetPercent / 100},
+	}
+}
+
+type hedgeContextKey struct{}
+
+// Handler marks the requests that can be hedged, they're hedged by the pool handler
+func (h *hedger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hedgeable(r) {
+			r = r.WithContext(context.WithValue(r.Context(), hedgeContextKey{}, h))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hedgerFromContext returns the hedger of the request, nil when it can't be hedged
+func hedgerFromContext(ctx context.Context) *hedger {
+	h, _ := ctx.Value(hedgeContextKey{}).(*hedger)
+	return h
+}
+
+// hedgeable tells whether sending r twice is harmless and its response comes at once
+func hedgeable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		r.ContentLength == 0 && len(r.TransferEncoding) == 0 &&
+		r.Header.Get("Upgrade") == "" &&
+		!strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serve proxies r to a server of pool, and to a second one when the first is slow
+func (h *hedger) serve(w http.ResponseWriter, r *http.Request, pool *ServerPool) {
+	server, release, ok := acquire(w, r, pool)
+	if !ok {
+		return
+	}
+	h.budget.deposit()
+
+	race := &hedgeRace{w: w, claimed: make(chan struct{})}
+	// The first copy's latency is recorded even when it loses, the time it took until then,
+	// otherwise the slow requests which got hedged would be left out of the percentile
+	firstDone := race.start(r, server, release, func(latency time.Duration, _ bool) {
+		h.latencies.record(latency)
+	})
+	defer func() {
+		race.wait()
+		// Panics such as http.ErrAbortHandler have to reach the server from the handler goroutine
+		if p := race.panicked(); p != nil {
+			panic(p)
+		}
+	}()
+
+	delay, ok := h.delay()
+	if !ok {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-race.claimed:
+		return
+	case <-firstDone:
+		return
+	}
+
+	if !h.budget.withdraw() {
+		hedgeMetrics.Add(h.route+" budget_exhausted", 1)
+		return
+	}
+	second, release, ok := hedgeServer(pool, server)
+	if !ok {
+		h.budget.refund()
+		return
+	}
+	hedgeMetrics.Add(h.route+" sent", 1)
+	race.start(r, second, release, func(_ time.Duration, won bool) {
+		if won {
+			hedgeMetrics.Add(h.route+" won", 1)
+		}
+	})
+}
+
+// delay returns how long a request waits before being hedged, false until enough latencies are known
+func (h *hedger) delay() (time.Duration, bool) {
+	delay, ok := h.latencies.quantile()
+	if !ok {
+		return 0, false
+	}
+	return max(delay, h.config.MinDelay.Duration), true
+}
+
+// hedgeServer returns an alive server of pool other than first with a free slot
+func hedgeServer(pool *ServerPool, first *Server) (*Server, func(), bool) {
+	for range pool.Servers() {
+		server := pool.GetServer()
+		if server == nil {
+			break
+		}
+		if server == first {
+			continue
+		}
+		if release, ok := server.queue.tryAcquire(); ok {
+			return server, release, true
+		}
+	}
+	return nil, nil, false
+}
+
+// hedgeRace lets the copies of a request race, the first one writing its response wins
+// and the others are cancelled
+type hedgeRace struct {
+	w       http.ResponseWriter
+	claimed chan struct{} // closed once a copy won
+
+	mutex   sync.Mutex
+	winner  *hedgeWriter
+	writers []*hedgeWriter
+	wg      sync.WaitGroup
+}
+
+// start proxies a copy of r to server, onClaim is called with its latency when a copy wins,
+// whether it's this one or not. The returned channel is closed when the copy is done.
+func (race *hedgeRace) start(r *http.Request, server *Server, release func(), onClaim func(latency time.Duration, won bool)) <-chan struct{} {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	hw := &hedgeWriter{race: race, header: http.Header{}, cancel: cancel, start: time.Now(), onClaim: onClaim}
+
+	race.mutex.Lock()
+	lost := race.winner != nil
+	race.writers = append(race.writers, hw)
+	race.mutex.Unlock()
+	if lost {
+		cancel(errHedgeLost)
+	}
+
+	done := make(chan struct{})
+	race.wg.Add(1)
+	go func() {
+		defer race.wg.Done()
+		defer close(done)
+		defer release()
+		defer cancel(nil)
+		// ReverseProxy panics when it can't copy a response body, for a loser cancelled
+		// in the middle or a client gone. Out of the handler goroutine it would crash the
+		// process, it's kept for serve to re-panic.
+		defer func() {
+			hw.panicked = recover()
+		}()
+		server.ServeHTTP(hw, r.Clone(ctx))
+	}()
+	return done
+}
+
+// wait returns once all the copies are done
+func (race *hedgeRace) wait() {
+	race.wg.Wait()
+}
+
+// panicked returns the panic of the winner, or of any copy when none won. The losers'
+// panics are dropped, they come from their cancellation. It's called once all are done.
+func (race *hedgeRace) panicked() any {
+	race.mutex.Lock()
+	defer race.mutex.Unlock()
+	if race.winner != nil {
+		return race.winner.panicked
+	}
+	for _, hw := range race.writers {
+		if hw.panicked != nil {
+			return hw.panicked
+		}
+	}
+	return nil
+}
+
+// claim makes hw the winner if there's none yet, it tells whether hw is the winner
+func (race *hedgeRace) claim(hw *hedgeWriter) bool {
+	race.mutex.Lock()
+	defer race.mutex.Unlock()
+	if race.winner != nil {
+		return race.winner == hw
+	}
+	race.winner = hw
+	close(race.claimed)
+	for _, other := range race.writers {
+		if other != hw {
+			other.cancel(errHedgeLost)
+		}
+	}
+	header := race.w.Header()
+	for k, vs := range hw.header {
+		header[k] = vs
+	}
+	for _, other := range race.writers {
+		other.onClaim(time.Since(other.start), other == hw)
+	}
+	return true
+}
+
+// hedgeWriter holds back the response of a copy until it wins the race
+type hedgeWriter struct {
+	race     *hedgeRace
+	header   http.Header
+	cancel   context.CancelCauseFunc
+	start    time.Time
+	onClaim  func(latency time.Duration, won bool)
+	won      bool
+	panicked any // recovered from the copy, set once it's done
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	if hw.won {
+		return hw.race.w.Header()
+	}
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(status int) {
+	if status < 200 && !hw.won {
+		return // 1xx responses of a copy that may lose are dropped
+	}
+	if hw.won || hw.claim() {
+		hw.race.w.WriteHeader(status)
+	}
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if !hw.won && !hw.claim() {
+		return 0, errHedgeLost
+	}
+	return hw.race.w.Write(b)
+}
+
+func (hw *hedgeWriter) Flush() {
+	if hw.won {
+		http.NewResponseController(hw.race.w).Flush()
+	}
+}
+
+func (hw *hedgeWriter) claim() bool {
+	hw.won = hw.race.claim(hw)
+	return hw.won
+}
+
+// latencyWindow keeps the recent latencies of a route, its percentile is recomputed
+// every few records
+type latencyWindow struct {
+	percentile float64
+
+	mutex   sync.Mutex
+	samples []time.Duration // ring buffer of hedgeWindowSize latencies
+	next    int
+	stale   int // records since the quantile was computed
+	cached  time.Duration
+}
+
+func (l *latencyWindow) record(latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.samples) < hedgeWindowSize {
+		l.samples = append(l.samples, latency)
+	} else {
+		l.samples[l.next] = latency
+	}
+	l.next = (l.next + 1) % hedgeWindowSize
+	l.stale++
+}
+
+// quantile returns the percentile of the recent latencies, false when there are too few
+func (l *latencyWindow) quantile() (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.samples) < hedgeMinSamples {
+		return 0, false
+	}
+	if l.cached == 0 || l.stale >= hedgeWindowSize/16 {
+		sorted := slices.Clone(l.samples)
+		slices.Sort(sorted)
+		l.cached = sorted[int(float64(len(sorted)-1)*l.percentile/100)]
+		l.stale = 0
+	}
+	return l.cached, true
+}
+
+// hedgeBudget is a token bucket filled by ratio tokens per request, a hedge costs a token
+type hedgeBudget struct {
+	ratio float64
+
+	mutex  sync.Mutex
+	tokens float64
+}
+
+func (b *hedgeBudget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens = min(hedgeBudgetMax, b.tokens+b.ratio)
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1-1e-9 { // absorbs the rounding of the fractional deposits
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *hedgeBudget) refund() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens++
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedger_serve(t *testing.T) {
+	slowCancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+			io.WriteString(w, "slow")
+		case <-r.Context().Done():
+			slowCancelled <- struct{}{}
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Origin", "fast")
+		io.WriteString(w, "fast")
+	}))
+	defer fast.Close()
+
+	pool := &ServerPool{index: -1}
+	pool.AddServer(NewServer(slow.URL))
+	pool.AddServer(NewServer(fast.URL))
+
+	h := newHedger("api", &HedgeConfig{BudgetPercent: 100})
+	serve := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		h.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hedgerFromContext(r.Context()).serve(w, r, pool)
+		})).ServeHTTP(w, r)
+		return w
+	}
+
+	// Without known latencies there's no hedging, requests alternate between the servers
+	start := time.Now()
+	assert.Equal(t, "slow", serve().Body.String())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, "fast", serve().Body.String())
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.latencies.record(20 * time.Millisecond)
+	}
+	sent, won := hedgeCount("api sent"), hedgeCount("api won")
+	samples := len(h.latencies.samples)
+	start = time.Now()
+	w := serve()
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, "fast", w.Body.String(), "the hedge answered first")
+	assert.Equal(t, "fast", w.Header().Get("X-Origin"))
+	select {
+	case <-slowCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow request was not cancelled")
+	}
+	assert.Equal(t, sent+1, hedgeCount("api sent"))
+	assert.Equal(t, won+1, hedgeCount("api won"))
+	// The slow first copy counts in the latencies although it lost
+	if assert.Len(t, h.latencies.samples, samples+1) {
+		assert.GreaterOrEqual(t, h.latencies.samples[samples], 20*time.Millisecond)
+	}
+}
+
+func TestHedger_aborts(t *testing.T) {
+	// Both origins answer at once and stream their body, the copy losing the race is
+	// cancelled in the middle of its body
+	arrived := make(chan struct{}, 2)
+	var answer sync.WaitGroup
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		answer.Wait()
+		for i := 0; i < 20; i++ {
+			if _, err := io.WriteString(w, "chunk "); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	origin1, origin2 := httptest.NewServer(origin), httptest.NewServer(origin)
+	defer origin1.Close()
+	defer origin2.Close()
+
+	pool := &ServerPool{index: -1}
+	pool.AddServer(NewServer(origin1.URL))
+	pool.AddServer(NewServer(origin2.URL))
+	h := newHedger("aborts", &HedgeConfig{BudgetPercent: 100})
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.latencies.record(time.Millisecond)
+	}
+	// Through a real server, whose request context makes ReverseProxy panic on copy errors
+	proxy := httptest.NewServer(h.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hedgerFromContext(r.Context()).serve(w, r, pool)
+	})))
+	defer proxy.Close()
+
+	for i := 0; i < 10; i++ {
+		answer.Add(1)
+		go func() {
+			<-arrived
+			<-arrived
+			answer.Done()
+		}()
+		resp, err := http.Get(proxy.URL)
+		if assert.NoError(t, err) {
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Repeat("chunk ", 20), string(b))
+		}
+	}
+
+	// A client leaving in the middle of the winner's body aborts the response
+	answer.Add(1)
+	go func() {
+		<-arrived
+		<-arrived
+		answer.Done()
+	}()
+	resp, err := http.Get(proxy.URL)
+	if assert.NoError(t, err) {
+		buf := make([]byte, 6)
+		_, err = io.ReadFull(resp.Body, buf)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	// Gives the proxy time to hit the closed connection, a panic out of the handler
+	// goroutine would crash the test
+	time.Sleep(200 * time.Millisecond)
+}
+
+func hedgeCount(key string) int64 {
+	if v, ok := hedgeMetrics.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestHedgeable(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header http.Header
+		want   bool
+	}{
+		{name: "get", method: http.MethodGet, want: true},
+		{name: "head", method: http.MethodHead, want: true},
+		{name: "post", method: http.MethodPost, body: "x"},
+		{name: "get with body", method: http.MethodGet, body: "x"},
+		{name: "websocket", method: http.MethodGet, header: http.Header{"Upgrade": {"websocket"}}},
+		{name: "event stream", method: http.MethodGet, header: http.Header{"Accept": {"text/event-stream"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = http.NoBody
+			}
+			r := httptest.NewRequest(tt.method, "/", body)
+			if tt.body != "" {
+				r.ContentLength = int64(len(tt.body))
+			}
+			for k, vs := range tt.header {
+				r.Header[k] = vs
+			}
+			assert.Equal(t, tt.want, hedgeable(r))
+		})
+	}
+}
+
+func TestLatencyWindow_quantile(t *testing.T) {
+	l := &latencyWindow{percentile: 95}
+	for i := 1; i < hedgeMinSamples; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+	_, ok := l.quantile()
+	assert.False(t, ok)
+
+	for i := hedgeMinSamples; i <= 100; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+	q, ok := l.quantile()
+	assert.True(t, ok)
+	assert.Equal(t, 95*time.Millisecond, q)
+
+	// Old latencies leave the window
+	for i := 0; i < hedgeWindowSize; i++ {
+		l.record(time.Second)
+	}
+	q, _ = l.quantile()
+	assert.Equal(t, time.Second, q)
+}
+
+func TestHedgeBudget(t *testing.T) {
+	b := &hedgeBudget{ratio: 0.1}
+	for i := 0; i < 9; i++ {
+		b.deposit()
+	}
+	assert.False(t, b.withdraw(), "9 requests at 10% don't pay a hedge")
+	b.deposit()
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+
+	for i := 0; i < 1000; i++ {
+		b.deposit()
+	}
+	hedges := 0
+	for b.withdraw() {
+		hedges++
+	}
+	assert.Equal(t, hedgeBudgetMax, hedges, "the budget saved up is capped")
+}
@@ -1,121 +1,486 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"proxy/adaptive"
+	"proxy/body"
+	"proxy/cache"
+	"proxy/compress"
+	"proxy/errpage"
+	"proxy/proxyproto"
+	"proxy/requestid"
+	"proxy/timeout"
+	"proxy/utils"
+
 	"golang.org/x/net/http2"
 )
 
 type Server struct {
 	Url     *url.URL
-	Alive   bool
 	Reverse *httputil.ReverseProxy
+
+	network, address string   // dialed by the transport, address is host:port or the socket path
+	target           *url.URL // where requests are sent, Url unless it names a socket
+
+	queue        *requestQueue
+	alive        atomic.Bool
+	warmingSince atomic.Int64 // unix nanoseconds of the slow start beginning, 0 when at full weight
 }
 
+// NewServer creates the server of a URL given at startup, an invalid one is fatal
 func NewServer(s string) *Server {
+	server, err := newServer(s)
+	if err != nil {
+		log.Fatalf("Invalid server %s: %v", s, err)
+	}
+	return server
+}
+
+// newServer creates the server of s, which may be a unix:// socket URL
+func newServer(s string) (*Server, error) {
 	url, err := url.Parse(s)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	network, address, target, err := utils.UpstreamAddr(url)
+	if err != nil {
+		return nil, err
 	}
 
+	dialer := &net.Dialer{
+		Timeout:   1 * time.Second,  // Adjust connection timeout as needed.
+		KeepAlive: 30 * time.Second, // Adjust keep-alive time as needed.
+	}
 	transport := &http.Transport{
 		MaxIdleConns:          100,              // Adjust based on expected load.
 		MaxIdleConnsPerHost:   10,               // Limit idle connections per host.
-		MaxConnsPerHost:       0,                // No limit on the total connections per host.
-		ResponseHeaderTimeout: 2 * time.Second,  // Adjust based on desired response time.
+		MaxConnsPerHost:       upstreamMaxConns, // 0 means no limit on the total connections per host.
 		ExpectContinueTimeout: 1 * time.Second,  // Adjust based on desired behavior.
 		IdleConnTimeout:       30 * time.Second, // Adjust based on desired connection reuse.
-		Dial: (&net.Dialer{
-			Timeout:   1 * time.Second,  // Adjust connection timeout as needed.
-			KeepAlive: 30 * time.Second, // Adjust keep-alive time as needed.
-		}).Dial,
+		// The response header timeout is enforced per route by the timeout package.
+		DialContext: dialer.DialContext,
+	}
+	if upstreamProxyProtocol > 0 {
+		// A connection carries the address of one client in its PROXY header, so it can't be reused
+		transport.DialContext = (&proxyproto.Dialer{Dialer: dialer, Version: upstreamProxyProtocol}).DialContext
+		transport.DisableKeepAlives = true
+	}
+	if network == "unix" {
+		// The transport dials the host of the target URL, the socket is dialed instead
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, network, address)
+		}
 	}
 
-	err = http2.ConfigureTransport(transport)
-	if err != nil {
-		log.Fatal(err)
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
 	}
 
 	reverse := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.URL.Scheme = url.Scheme
-			req.URL.Host = url.Host
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
 		},
 		Transport: transport,
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			http.Error(w, fmt.Sprintf("Origin server error %s", err), http.StatusInternalServerError)
+			if writeCancelled(w, r) {
+				return
+			}
+			// The error names internal addresses, it is only logged
+			errpage.Internal(w, r, http.StatusInternalServerError, "Origin server error", err)
 		},
 	}
 
-	return &Server{
+	server := &Server{
 		Url:     url,
-		Alive:   true,
 		Reverse: reverse,
+		network: network,
+		address: address,
+		target:  target,
+		queue:   newRequestQueue(upstreamLimits),
+	}
+	server.alive.Store(true)
+	return server, nil
+}
+
+// writeCancelled answers a request cancelled by a policy of its route, such as a timeout,
+// with the matching error. It returns false when the cancellation has no such cause.
+func writeCancelled(w http.ResponseWriter, r *http.Request) bool {
+	switch cause := context.Cause(r.Context()); {
+	case errors.Is(cause, timeout.ErrResponseHeaderTimeout), errors.Is(cause, timeout.ErrRequestTimeout):
+		errpage.Write(w, r, http.StatusGatewayTimeout, "Origin server timeout")
+	case errors.Is(cause, body.ErrTooLarge):
+		errpage.Write(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+	case errors.Is(cause, body.ErrTooSlow):
+		errpage.Write(w, r, http.StatusRequestTimeout, "Request body upload too slow")
+	default:
+		return false
+	}
+	return true
+}
+
+// ServeHTTP proxies the request to the server, tracking streamed responses and upgraded connections
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if upstreamProxyProtocol > 0 {
+		r = withClientAddrs(r)
+	}
+	if r.Header.Get("Upgrade") != "" {
+		streamMetrics.Add(s.address, 1)
+		streamMetrics.Add("total", 1)
+		defer streamMetrics.Add(s.address, -1)
+		s.Reverse.ServeHTTP(w, r)
+		return
+	}
+	sw := newStreamWriter(w, s)
+	defer sw.close()
+	s.Reverse.ServeHTTP(sw, r)
+}
+
+func (s *Server) IsAlive() bool {
+	return s.alive.Load()
+}
+
+// SetAlive records the health of the server, a server coming back to life starts slowly
+func (s *Server) SetAlive(alive bool, slowStart slowStart) {
+	if s.alive.Swap(alive) == alive {
+		return
+	}
+	if alive {
+		log.Printf("Server %s is back", s.Url)
+		s.startSlowly(slowStart)
+	} else {
+		log.Printf("Server %s is down", s.Url)
 	}
 }
 
 type ServerPool struct {
-	servers []*Server
-	index   int64
+	mutex     sync.RWMutex
+	servers   []*Server
+	index     int64
+	slowStart slowStart // applies to the servers added or recovering once it's set
+	limiter   *adaptive.Limiter
 }
 
 func (s *ServerPool) AddServer(server *Server) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	server.startSlowly(s.slowStart)
 	s.servers = append(s.servers, server)
 }
 
+// Servers returns a snapshot of the pool's servers
+func (s *ServerPool) Servers() []*Server {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]*Server(nil), s.servers...)
+}
+
+// HasHost tells whether host is the address of one of the pool's servers
+func (s *ServerPool) HasHost(host string) bool {
+	for _, server := range s.Servers() {
+		if server.address == host {
+			return true
+		}
+	}
+	return false
+}
+
+// GetServer returns the next alive server in round-robin order, nil when none is alive.
+// A server in slow start is only accepted with a probability equal to its current weight,
+// otherwise the next one is tried. The servers all in slow start, the first alive one is returned.
 func (s *ServerPool) GetServer() *Server {
-	atomic.AddInt64(&s.index, 1)
-	//TODO: check overflow s.index
-	return s.servers[s.index%int64(len(s.servers))]
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := uint64(len(s.servers))
+	var fallback *Server
+	for i := uint64(0); i < n; i++ {
+		server := s.servers[uint64(atomic.AddInt64(&s.index, 1))%n]
+		if !server.IsAlive() {
+			continue
+		}
+		if weight := server.weight(s.slowStart); weight >= 1 || rand.Float64() < weight {
+			return server
+		}
+		if fallback == nil {
+			fallback = server
+		}
+	}
+	return fallback
+}
+
+// pools are the server pools by name
+type pools map[string]*ServerPool
+
+// hasHost tells whether host is the address of a server of any pool
+func (p pools) hasHost(host string) bool {
+	for _, pool := range p {
+		if pool.HasHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the pool called name, or fallback when name is empty. The pool must have servers.
+func (p pools) get(name, fallback string) (*ServerPool, error) {
+	if name == "" {
+		name = fallback
+	}
+	pool, ok := p[name]
+	if !ok || len(pool.Servers()) == 0 {
+		return nil, fmt.Errorf("pool %q is not defined or has no servers", name)
+	}
+	return pool, nil
+}
+
+type poolContextKey struct{}
+
+// withPool returns a copy of r to be served by pool instead of the default one
+func withPool(r *http.Request, pool *ServerPool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), poolContextKey{}, pool))
+}
+
+// poolFromContext returns the pool set by withPool, or fallback
+func poolFromContext(ctx context.Context, fallback *ServerPool) *ServerPool {
+	if pool, ok := ctx.Value(poolContextKey{}).(*ServerPool); ok {
+		return pool
+	}
+	return fallback
 }
 
 func main() {
 	var serversArg string
 	var websocketArg string
-	flag.StringVar(&serversArg, "servers", "", "Load balanced servers, use commas to separate")
+	var configArg string
+	var shadowServersArg string
+	var adminArg string
+	var cacheSizeArg, cacheDiskSizeArg int64
+	var cacheDirArg string
+	var compressArg bool
+	var sseHeartbeatArg time.Duration
+	var healthIntervalArg, slowStartArg time.Duration
+	var healthPathArg string
+	var slowStartExpArg bool
+	var proxyProtocolArg string
+	var trustedProxiesArg string
+	var errorPagesArg string
+	var accessLogArg string
+	var adaptiveArg bool
+	var adaptiveMinArg, adaptiveMaxArg int
+	flag.StringVar(&serversArg, "servers", "", "Load balanced servers, http://host:port or unix:///path/to.sock URLs separated by commas")
 	flag.StringVar(&websocketArg, "websocket", "", "Whether to use websocket")
+	flag.StringVar(&shadowServersArg, "shadow-servers", "", "Servers receiving mirrored traffic, use commas to separate")
+	flag.StringVar(&configArg, "config", "", "JSON config file with the routes settings")
+	flag.StringVar(&adminArg, "admin", "127.0.0.1:9091", "Admin API address, empty to disable")
+	flag.Int64Var(&cacheSizeArg, "cache-size", 0, "In-memory response cache size in bytes, 0 to disable caching")
+	flag.StringVar(&cacheDirArg, "cache-dir", "", "Directory of the on-disk response cache tier")
+	flag.Int64Var(&cacheDiskSizeArg, "cache-disk-size", 1<<30, "On-disk response cache size in bytes")
+	flag.BoolVar(&compressArg, "compress", false, "Compress responses with gzip, deflate or zstd")
+	flag.DurationVar(&sseHeartbeatArg, "sse-heartbeat", streamHeartbeat, "Silence after which a comment is sent on event streams, 0 to disable")
+	flag.DurationVar(&healthIntervalArg, "health-interval", 0, "Interval between server health checks, 0 to disable")
+	flag.StringVar(&healthPathArg, "health-path", "", "Path of the HTTP health check, servers are only dialed when empty")
+	flag.DurationVar(&slowStartArg, "slow-start", 0, "Time for new and recovered servers to ramp up to their full weight")
+	flag.BoolVar(&slowStartExpArg, "slow-start-exponential", false, "Ramp the slow start weight exponentially instead of linearly")
+	flag.IntVar(&upstreamMaxConns, "max-conns", 0, "Maximum connections to each server, 0 for unlimited")
+	flag.IntVar(&upstreamLimits.MaxInFlight, "max-in-flight", 0, "Maximum concurrent requests to each server, 0 for unlimited")
+	flag.IntVar(&upstreamLimits.MaxQueue, "max-queue", 100, "Requests waiting for a server once it has max-in-flight requests")
+	flag.DurationVar(&upstreamLimits.QueueTimeout, "queue-timeout", 5*time.Second, "Time a request waits for a server before being rejected")
+	flag.StringVar(&proxyProtocolArg, "proxy-protocol-from", "", "CIDRs of the load balancers sending PROXY protocol headers, use commas to separate")
+	flag.StringVar(&trustedProxiesArg, "trusted-proxies", "", "CIDRs of the proxies whose X-Forwarded-For and X-Real-IP headers give the client IP, use commas to separate")
+	flag.IntVar(&upstreamProxyProtocol, "upstream-proxy-protocol", 0, "PROXY protocol version sent to the servers, 1 or 2, 0 to disable")
+	flag.StringVar(&errorPagesArg, "error-pages", "", "Directory of HTML error page templates such as 404.html, 5xx.html or default.html")
+	flag.StringVar(&accessLogArg, "access-log", "", "Access log file, - for the standard output, empty to disable")
+	flag.BoolVar(&adaptiveArg, "adaptive-concurrency", false, "Shed requests above a concurrency limit following the latency of each pool")
+	flag.IntVar(&adaptiveMinArg, "adaptive-min", 5, "Lowest adaptive concurrency limit of a pool")
+	flag.IntVar(&adaptiveMaxArg, "adaptive-max", 1000, "Highest adaptive concurrency limit of a pool")
 	flag.Parse()
-	if len(serversArg) == 0 {
+	if upstreamProxyProtocol < 0 || upstreamProxyProtocol > 2 {
+		log.Fatal("Invalid upstream-proxy-protocol parameter")
+	}
+	streamHeartbeat = sseHeartbeatArg
+	if trustedProxiesArg != "" {
+		trusted, err := parsePrefixes(trustedProxiesArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		utils.SetTrustedProxies(trusted)
+	}
+
+	if errorPagesArg != "" {
+		renderer, err := errpage.LoadTemplates(errorPagesArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		errpage.Default = renderer
+	}
+
+	config := &Config{}
+	if configArg != "" {
+		var err error
+		if config, err = loadConfig(configArg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(serversArg) == 0 && config.Discovery["default"] == nil {
 		log.Fatal("Missing servers parameter")
 	}
 
-	servers := strings.Split(serversArg, ",")
 	serverPool := ServerPool{index: -1}
-	for _, s := range servers {
-		serverPool.AddServer(NewServer(s))
+	if len(serversArg) > 0 {
+		for _, s := range strings.Split(serversArg, ",") {
+			serverPool.AddServer(NewServer(s))
+		}
+	}
+	shadowPool := ServerPool{index: -1}
+	if len(shadowServersArg) > 0 {
+		for _, s := range strings.Split(shadowServersArg, ",") {
+			shadowPool.AddServer(NewServer(s))
+		}
+	}
+	serverPools := pools{"default": &serverPool, "shadow": &shadowPool}
+	for name, servers := range config.Pools {
+		if _, ok := serverPools[name]; ok || len(servers) == 0 {
+			log.Fatalf("Invalid pool %s", name)
+		}
+		pool := &ServerPool{index: -1}
+		for _, s := range servers {
+			pool.AddServer(NewServer(s))
+		}
+		serverPools[name] = pool
+	}
+	for name, d := range config.Discovery {
+		provider, err := d.provider()
+		if err != nil {
+			log.Fatalf("Invalid discovery of pool %s: %v", name, err)
+		}
+		pool, ok := serverPools[name]
+		if !ok {
+			pool = &ServerPool{index: -1}
+			serverPools[name] = pool
+		} else if len(pool.Servers()) > 0 {
+			log.Fatalf("Pool %s has both servers and discovery", name)
+		}
+		if err := pool.discover(provider); err != nil {
+			log.Fatalf("Discovery of pool %s failed: %v", name, err)
+		}
+	}
+	for _, pool := range serverPools {
+		pool.SetSlowStart(slowStart{Duration: slowStartArg, Exponential: slowStartExpArg})
+		if adaptiveArg {
+			pool.limiter = adaptive.New(adaptive.Options{MinLimit: adaptiveMinArg, MaxLimit: adaptiveMaxArg})
+		}
+		if healthIntervalArg > 0 {
+			go pool.healthCheck(healthIntervalArg, healthPathArg)
+		}
 	}
+	publishPools(serverPools)
+	publishLimits(serverPools)
 
 	host := "127.0.0.1:9090"
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		server := serverPool.GetServer()
-		if server != nil {
-			server.Reverse.ServeHTTP(w, r)
+	adminMux := http.NewServeMux()
+	registerMetricsAdmin(adminMux)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool := poolFromContext(r.Context(), &serverPool)
+		w, done, ok := pool.admit(w, r)
+		if !ok {
+			return
+		}
+		defer done()
+		if h := hedgerFromContext(r.Context()); h != nil {
+			h.serve(w, r, pool)
 			return
 		}
-		http.Error(w, "Origin server unavailable", http.StatusServiceUnavailable)
+		if server, release, ok := acquire(w, r, pool); ok {
+			defer release()
+			server.ServeHTTP(w, r)
+		}
 	})
 
+	if cacheSizeArg > 0 {
+		c, err := cache.NewCache(cache.Options{
+			MaxBytes:     cacheSizeArg,
+			Dir:          cacheDirArg,
+			MaxDiskBytes: cacheDiskSizeArg,
+			Partition:    cachePartition,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = c.Handler(handler)
+		registerCacheAdmin(adminMux, c)
+	}
+
+	router, err := newRouter(config, handler, serverPools)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerSplitAdmin(adminMux, router.splitters)
+	registerFaultAdmin(adminMux, router.faults)
+	handler = router
+	if compressArg {
+		handler = compress.Handler(handler, compress.DefaultOptions)
+	}
+	switch accessLogArg {
+	case "":
+	case "-":
+		handler = accessLog(handler, os.Stdout)
+	default:
+		f, err := os.OpenFile(accessLogArg, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = accessLog(handler, f)
+	}
+	handler = requestid.Handler(handler)
+
+	// Read and write timeouts are set per request by the routes, a server-wide
+	// WriteTimeout would cut uploads, websockets and gRPC streams.
 	proxy := http.Server{
 		Addr:              host,
-		ReadTimeout:       1 * time.Second,
-		WriteTimeout:      1 * time.Second,
-		ReadHeaderTimeout: 2 * time.Second,
+		ReadHeaderTimeout: config.headerReadTimeout(),
 		IdleTimeout:       30 * time.Second,
 		Handler:           handler,
-		// Handler: token_bucket.RequestThrottler(handler, 100),
+	}
+
+	if adminArg != "" {
+		go func() {
+			log.Printf("Admin API started at %s\n", adminArg)
+			if err := http.ListenAndServe(adminArg, adminMux); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
 
 	log.Printf("Proxy started at %s\n", host)
-	if err := proxy.ListenAndServe(); err != nil {
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if proxyProtocolArg != "" {
+		trusted, err := parsePrefixes(proxyProtocolArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener = proxyproto.NewListener(listener, trusted)
+	}
+	if err := proxy.Serve(listener); err != nil {
 		log.Fatal(err)
 	}
 }
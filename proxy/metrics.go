@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Every feature publishes its counters as an expvar.Map, they're all served
+// as one JSON document on the admin API.
+var (
+	mirrorMetrics = expvar.NewMap("mirror")
+	splitMetrics  = expvar.NewMap("split")
+	streamMetrics = expvar.NewMap("streams") // open streams by upstream host, and the total opened
+	healthMetrics = expvar.NewMap("health")
+	queueMetrics  = expvar.NewMap("queues") // requests overflowing to another server, rejected or cancelled while queued
+	// IP filter hits by route, list and CIDR, "unlisted" counts the requests blocked by matching no allowed CIDR
+	ipFilterMetrics  = expvar.NewMap("ip_filter")
+	faultMetrics     = expvar.NewMap("faults")     // injected faults by route and kind
+	hedgeMetrics     = expvar.NewMap("hedges")     // hedges sent, won, or not sent for lack of budget, by route
+	shedMetrics      = expvar.NewMap("shedding")   // requests admitted or shed by route and priority
+	rateLimitMetrics = expvar.NewMap("rate_limit") // requests allowed or rejected by route
+)
+
+// publishPools adds the state of every server to the metrics
+func publishPools(serverPools pools) {
+	expvar.Publish("pools", expvar.Func(func() any {
+		state := map[string][]map[string]any{}
+		for name, pool := range serverPools {
+			for _, server := range pool.Servers() {
+				inFlight, queued := server.queue.depth()
+				state[name] = append(state[name], map[string]any{
+					"url":       server.Url.String(),
+					"alive":     server.IsAlive(),
+					"weight":    server.weight(pool.slowStart),
+					"in_flight": inFlight,
+					"queued":    queued,
+				})
+			}
+		}
+		return state
+	}))
+}
+
+// registerMetricsAdmin adds GET /metrics to the admin API
+func registerMetricsAdmin(mux *http.ServeMux) {
+	mux.Handle("/metrics", expvar.Handler())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxMirrorsInFlight bounds the mirrored requests waiting on the shadow pool,
+// new ones are dropped once it's reached so a slow shadow can't pile up goroutines.
+const maxMirrorsInFlight = 256
+
+// defaultMirrorBodyBytes is the largest request body mirrored when the route sets no limit
+const defaultMirrorBodyBytes = 1 << 20
+
+// mirror copies a percentage of the requests to a shadow pool. Shadow responses are
+// discarded, only their outcome is recorded in the "mirror" metrics. Mirrored requests
+// are sent straight to the shadow servers so they never go through the client facing
+// route handlers such as the rate limiters.
+type mirror struct {
+	pool         *ServerPool
+	percent      float64
+	maxBodyBytes int64
+	timeout      time.Duration
+	inFlight     chan struct{}
+}
+
+func newMirror(pool *ServerPool, config *MirrorConfig) *mirror {
+	m := &mirror{
+		pool:         pool,
+		percent:      config.Percent,
+		maxBodyBytes: config.MaxBodyBytes,
+		timeout:      config.Timeout.Duration,
+		inFlight:     make(chan struct{}, maxMirrorsInFlight),
+	}
+	if m.maxBodyBytes <= 0 {
+		m.maxBodyBytes = defaultMirrorBodyBytes
+	}
+	if m.timeout <= 0 {
+		m.timeout = 5 * time.Second
+	}
+	return m
+}
+
+func (m *mirror) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 >= m.percent || r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := m.bufferBody(r)
+		if !ok {
+			mirrorMetrics.Add("skipped_body_too_large", 1)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+			ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+			shadow := r.Clone(ctx)
+			shadow.Body = io.NopCloser(bytes.NewReader(body))
+			shadow.Header.Set("X-Mirrored-By", "proxy")
+			go func() {
+				defer func() { <-m.inFlight }()
+				defer cancel()
+				m.send(shadow)
+			}()
+		default:
+			mirrorMetrics.Add("dropped", 1)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// bufferBody reads the request body up to maxBodyBytes so it can be sent twice.
+// It returns false when the body is too large to be mirrored, r.Body is left readable in any case.
+func (m *mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.maxBodyBytes {
+		return nil, false
+	}
+	if r.GetBody != nil {
+		// the body was buffered by the route already, read a copy of it
+		rc, err := r.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		defer rc.Close()
+		body, err := io.ReadAll(rc)
+		return body, err == nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodyBytes+1))
+	rest := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rest), rest}
+	if err != nil || int64(len(body)) > m.maxBodyBytes {
+		return nil, false
+	}
+	return body, true
+}
+
+func (m *mirror) send(r *http.Request) {
+	server := m.pool.GetServer()
+	if server == nil {
+		mirrorMetrics.Add("errors", 1)
+		return
+	}
+
+	start := time.Now()
+	w := &discardWriter{header: http.Header{}}
+	server.Reverse.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	mirrorMetrics.Add("requests", 1)
+	mirrorMetrics.Add("latency_ms_total", time.Since(start).Milliseconds())
+	mirrorMetrics.Add("status_"+strconv.Itoa(w.status/100)+"xx", 1)
+	if r.Context().Err() != nil {
+		mirrorMetrics.Add("timeouts", 1)
+	}
+	if w.status >= http.StatusInternalServerError {
+		log.Printf("mirror: %s %s answered %d by %s", r.Method, r.URL.Path, w.status, server.address)
+	}
+}
+
+// discardWriter is the ResponseWriter of mirrored requests, it only keeps the status code
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) WriteHeader(status int) {
+	if d.status == 0 && status >= 200 {
+		d.status = status
+	}
+}
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(p), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror_Handler(t *testing.T) {
+	shadowBodies := make(chan string, 1)
+	shadowOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- r.Header.Get("X-Mirrored-By") + ":" + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadowOrigin.Close()
+
+	shadowPool := &ServerPool{index: -1}
+	shadowPool.AddServer(NewServer(shadowOrigin.URL))
+	m := newMirror(shadowPool, &MirrorConfig{Percent: 100, MaxBodyBytes: 16})
+
+	var primaryBody string
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		primaryBody = string(body)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/post", strings.NewReader("payload")))
+	assert.Equal(t, "payload", primaryBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	select {
+	case got := <-shadowBodies:
+		assert.Equal(t, "proxy:payload", got)
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// bodies over the limit reach the primary pool in full but are not mirrored
+	large := strings.Repeat("a", 32)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(large)))
+	assert.Equal(t, large, primaryBody)
+	select {
+	case <-shadowBodies:
+		t.Fatal("request over the body limit was mirrored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirror_defaultBodyLimit(t *testing.T) {
+	shadowBodies := make(chan string, 1)
+	shadowOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- string(body)
+	}))
+	defer shadowOrigin.Close()
+
+	shadowPool := &ServerPool{index: -1}
+	shadowPool.AddServer(NewServer(shadowOrigin.URL))
+	m := newMirror(shadowPool, &MirrorConfig{Percent: 100})
+
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/post", strings.NewReader("payload")))
+	select {
+	case got := <-shadowBodies:
+		assert.Equal(t, "payload", got, "bodies are mirrored without a configured limit")
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"proxy/proxyproto"
+)
+
+// upstreamProxyProtocol is the PROXY protocol version sent to the servers, 0 when none is sent
+var upstreamProxyProtocol int
+
+// withClientAddrs returns a copy of r whose upstream connection sends the addresses
+// of the client connection in its PROXY header
+func withClientAddrs(r *http.Request) *http.Request {
+	source, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	var destination netip.AddrPort
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		destination, _ = netip.ParseAddrPort(local.String())
+	}
+	return r.WithContext(proxyproto.WithAddrs(r.Context(), source, destination))
+}
+
+// parsePrefixes parses comma separated CIDRs or IP addresses
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"proxy/errpage"
+)
+
+var (
+	errQueueFull    = errors.New("server queue is full")
+	errQueueTimeout = errors.New("timed out in server queue")
+)
+
+// queueLimits bound the concurrent requests to one server
+type queueLimits struct {
+	MaxInFlight  int           // requests proxied at once, 0 for unlimited
+	MaxQueue     int           // requests waiting for one of the MaxInFlight slots
+	QueueTimeout time.Duration // time a request waits in the queue before being rejected, 0 for no limit
+}
+
+// upstreamLimits and upstreamMaxConns apply to every server, they're set by the command-line flags
+var (
+	upstreamLimits   queueLimits
+	upstreamMaxConns int
+)
+
+// retryAfter returns the Retry-After header value for a wait, in whole seconds and at least 1
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
+
+// requestQueue admits up to MaxInFlight requests at once, the next ones wait their
+// turn in FIFO order. A freed slot is handed over to the oldest waiting request.
+type requestQueue struct {
+	limits queueLimits
+
+	mutex    sync.Mutex
+	inFlight int
+	waiting  list.List // of chan struct{}, closed when the request gets its slot
+}
+
+func newRequestQueue(limits queueLimits) *requestQueue {
+	return &requestQueue{limits: limits}
+}
+
+// acquire waits for a slot, release must be called once the request is done.
+// It fails right away with errQueueFull when the queue has no room left.
+func (q *requestQueue) acquire(ctx context.Context) (release func(), err error) {
+	q.mutex.Lock()
+	if q.limits.MaxInFlight <= 0 || q.inFlight < q.limits.MaxInFlight {
+		q.inFlight++
+		q.mutex.Unlock()
+		return q.release, nil
+	}
+	if q.waiting.Len() >= q.limits.MaxQueue {
+		q.mutex.Unlock()
+		return nil, errQueueFull
+	}
+	ready := make(chan struct{})
+	elem := q.waiting.PushBack(ready)
+	q.mutex.Unlock()
+
+	var expired <-chan time.Time
+	if q.limits.QueueTimeout > 0 {
+		timer := time.NewTimer(q.limits.QueueTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-ready:
+		return q.release, nil
+	case <-expired:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	select {
+	case <-ready:
+		// The slot was handed over while giving up, pass it on
+		q.releaseLocked()
+	default:
+		q.waiting.Remove(elem)
+	}
+	return nil, err
+}
+
+// tryAcquire takes a slot only when one is free right away, without queueing
+func (q *requestQueue) tryAcquire() (release func(), ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.limits.MaxInFlight > 0 && q.inFlight >= q.limits.MaxInFlight {
+		return nil, false
+	}
+	q.inFlight++
+	return q.release, true
+}
+
+func (q *requestQueue) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.releaseLocked()
+}
+
+func (q *requestQueue) releaseLocked() {
+	if front := q.waiting.Front(); front != nil {
+		close(q.waiting.Remove(front).(chan struct{}))
+		return
+	}
+	q.inFlight--
+}
+
+// depth returns the number of requests in flight and waiting
+func (q *requestQueue) depth() (inFlight, queued int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.inFlight, q.waiting.Len()
+}
+
+// Acquire picks a server and waits for one of its slots. When the server's queue is full,
+// the request overflows to the other alive servers. It returns errQueueFull when all servers
+// are saturated and a nil server when none is alive.
+func (s *ServerPool) Acquire(ctx context.Context) (*Server, func(), error) {
+	first := s.GetServer()
+	if first == nil {
+		return nil, nil, nil
+	}
+	candidates := []*Server{first}
+	for _, server := range s.Servers() {
+		if server != first && server.IsAlive() {
+			candidates = append(candidates, server)
+		}
+	}
+
+	for _, server := range candidates {
+		release, err := server.queue.acquire(ctx)
+		if errors.Is(err, errQueueFull) {
+			queueMetrics.Add("overflows", 1)
+			continue
+		}
+		if err != nil {
+			return server, nil, err
+		}
+		return server, release, nil
+	}
+	return nil, nil, errQueueFull
+}
+
+// acquire gets a server of pool for r, it answers the request itself when there's none
+func acquire(w http.ResponseWriter, r *http.Request, pool *ServerPool) (*Server, func(), bool) {
+	server, release, err := pool.Acquire(r.Context())
+	switch {
+	case server == nil && err == nil:
+		errpage.Write(w, r, http.StatusServiceUnavailable, "Origin server unavailable")
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		queueMetrics.Add("rejected", 1)
+		w.Header().Set("Retry-After", retryAfter(upstreamLimits.QueueTimeout))
+		errpage.Write(w, r, http.StatusServiceUnavailable, "Origin servers saturated")
+	case err != nil:
+		// The request was cancelled while queued, by its route timeout or because the
+		// client is gone, in which case there's no one to answer
+		queueMetrics.Add("cancelled", 1)
+		writeCancelled(w, r)
+	default:
+		return server, release, true
+	}
+	return nil, nil, false
+}
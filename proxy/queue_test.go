@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/timeout"
+)
+
+func TestRequestQueue_acquire(t *testing.T) {
+	q := newRequestQueue(queueLimits{MaxInFlight: 1, MaxQueue: 2, QueueTimeout: time.Second})
+
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+
+	// Two requests queue up, they must get the slot in order
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			release, err := q.acquire(context.Background())
+			if assert.NoError(t, err) {
+				order <- i
+				time.Sleep(10 * time.Millisecond)
+				release()
+			}
+		}(i)
+		assert.Eventually(t, func() bool { _, queued := q.depth(); return queued == i }, time.Second, time.Millisecond)
+	}
+
+	_, err = q.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueueFull)
+
+	release()
+	assert.Equal(t, 1, <-order)
+	assert.Equal(t, 2, <-order)
+	assert.Eventually(t, func() bool { inFlight, _ := q.depth(); return inFlight == 0 }, time.Second, time.Millisecond)
+}
+
+func TestRequestQueue_timeout(t *testing.T) {
+	q := newRequestQueue(queueLimits{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 20 * time.Millisecond})
+	release, err := q.acquire(context.Background())
+	assert.NoError(t, err)
+
+	_, err = q.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = q.acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	inFlight, queued := q.depth()
+	assert.Equal(t, 1, inFlight)
+	assert.Zero(t, queued)
+	release()
+	inFlight, _ = q.depth()
+	assert.Zero(t, inFlight)
+}
+
+func TestServerPool_Acquire(t *testing.T) {
+	pool := &ServerPool{index: -1}
+	for _, s := range []string{"http://127.0.0.1:8081", "http://127.0.0.1:8082"} {
+		server := NewServer(s)
+		server.queue = newRequestQueue(queueLimits{MaxInFlight: 1})
+		pool.AddServer(server)
+	}
+
+	first, releaseFirst, err := pool.Acquire(context.Background())
+	assert.NoError(t, err)
+	second, releaseSecond, err := pool.Acquire(context.Background())
+	assert.NoError(t, err)
+	assert.NotSame(t, first, second, "a full server overflows to the other one")
+
+	_, _, err = pool.Acquire(context.Background())
+	assert.ErrorIs(t, err, errQueueFull)
+
+	releaseSecond()
+	server, release, err := pool.Acquire(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, second, server)
+	release()
+	releaseFirst()
+
+	for _, server := range pool.Servers() {
+		server.SetAlive(false, pool.slowStart)
+	}
+	server, _, err = pool.Acquire(context.Background())
+	assert.Nil(t, server)
+	assert.NoError(t, err)
+}
+
+func TestAcquire_cancelled(t *testing.T) {
+	pool := &ServerPool{index: -1}
+	server := NewServer("http://127.0.0.1:8081")
+	server.queue = newRequestQueue(queueLimits{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+	pool.AddServer(server)
+	_, release, err := pool.Acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, release, ok := acquire(w, r, pool); ok {
+			release()
+		}
+	})
+
+	// The route timeout expires while the request is queued
+	w := httptest.NewRecorder()
+	timeout.Handler(h, timeout.Policy{Request: 50 * time.Millisecond}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	// Nobody is left to answer when the client cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	assert.False(t, w.Flushed)
+	assert.Empty(t, w.Body.String())
+	assert.Empty(t, w.Header())
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, "1", retryAfter(0))
+	assert.Equal(t, "2", retryAfter(1500*time.Millisecond))
+	assert.Equal(t, "5", retryAfter(5*time.Second))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"proxy/auth"
+	"proxy/body"
+	"proxy/fault"
+	"proxy/ipfilter"
+	"proxy/ratelimit"
+	"proxy/rewrite"
+	"proxy/shed"
+	"proxy/timeout"
+)
+
+// ipFilterReload is the interval between checks of the IP filter files
+const ipFilterReload = 5 * time.Second
+
+type route struct {
+	name    string
+	prefix  string
+	handler http.Handler
+}
+
+// router dispatches requests to the route with the longest matching path prefix.
+// Requests matching no configured route go through a default route without any rule.
+type router struct {
+	routes    []*route
+	splitters map[string]*splitter       // by route name
+	faults    map[string]*fault.Injector // by route name, set through the admin API
+}
+
+func newRouter(config *Config, next http.Handler, serverPools pools) (*router, error) {
+	rt := &router{splitters: map[string]*splitter{}, faults: map[string]*fault.Injector{}}
+	configs := config.Routes
+	hasDefault := false
+	for _, c := range configs {
+		hasDefault = hasDefault || c.PathPrefix == "/" || c.PathPrefix == ""
+	}
+	if !hasDefault {
+		configs = append(configs, RouteConfig{Name: "default", PathPrefix: "/"})
+	}
+
+	for _, c := range configs {
+		if c.Timeouts != nil && c.Timeouts.HeaderRead.Duration != 0 {
+			return nil, fmt.Errorf("route %s: header_read can only be set in the top-level timeouts", c.Name)
+		}
+		if c.Timeouts == nil {
+			c.Timeouts = config.Timeouts
+		}
+		if c.Timeouts == nil {
+			c.Timeouts = &defaultTimeouts
+		}
+		r, err := rt.newRoute(c, next, serverPools)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", c.Name, err)
+		}
+		rt.routes = append(rt.routes, r)
+	}
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].prefix) > len(rt.routes[j].prefix)
+	})
+	return rt, nil
+}
+
+// newRoute builds the handler chain of a route in front of next
+func (rt *router) newRoute(config RouteConfig, next http.Handler, serverPools pools) (*route, error) {
+	r := &route{name: config.Name, prefix: config.PathPrefix, handler: next}
+	if r.prefix == "" {
+		r.prefix = "/"
+	}
+	if r.name == "" {
+		r.name = r.prefix
+	}
+
+	pool, err := serverPools.get(config.Pool, "default")
+	if err != nil {
+		return nil, err
+	}
+	if config.Split != nil {
+		canary, err := serverPools.get(config.Split.Pool, "")
+		if err != nil {
+			return nil, fmt.Errorf("split: %w", err)
+		}
+		s := newSplitter(r.name, pool, canary, config.Split)
+		rt.splitters[r.name] = s
+		r.handler = s.Handler(r.handler)
+	} else {
+		r.handler = usePool(r.handler, pool)
+	}
+	if config.Hedge != nil {
+		r.handler = newHedger(r.name, config.Hedge).Handler(r.handler)
+	}
+	if config.Mirror != nil {
+		shadow, err := serverPools.get(config.Mirror.Pool, "shadow")
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+		r.handler = newMirror(shadow, config.Mirror).Handler(r.handler)
+	}
+	rewriter, err := rewrite.New(config.Rewrite, serverPools.hasHost)
+	if err != nil {
+		return nil, err
+	}
+	r.handler = rewriter.Handler(r.handler)
+	injector := &fault.Injector{OnInject: func(kind string) {
+		faultMetrics.Add(r.name+" "+kind, 1)
+	}}
+	rt.faults[r.name] = injector
+	r.handler = injector.Handler(r.handler)
+	if config.Body != nil {
+		r.handler = body.Handler(r.handler, config.Body.policy())
+	}
+	// Requests are shed once authenticated, their identity can set their priority
+	if config.Shedding != nil {
+		policy, err := config.Shedding.policy(pool)
+		if err != nil {
+			return nil, fmt.Errorf("shedding: %w", err)
+		}
+		policy.OnDecision = func(_ *http.Request, d shed.Decision) {
+			decision := "shed"
+			if d.Admitted {
+				decision = "admitted"
+			}
+			shedMetrics.Add(r.name+" "+d.Priority.String()+" "+decision, 1)
+		}
+		r.handler = shed.Handler(r.handler, policy)
+	}
+	// Clients are rate limited once authenticated, each identity can have its own quota
+	if config.RateLimit != nil {
+		limiter, err := config.RateLimit.limiter()
+		if err != nil {
+			return nil, fmt.Errorf("rate limit: %w", err)
+		}
+		key, err := config.RateLimit.key()
+		if err != nil {
+			return nil, fmt.Errorf("rate limit: %w", err)
+		}
+		r.handler = ratelimit.Handler(r.handler, limiter, ratelimit.Policy{
+			Key:           key,
+			LegacyHeaders: config.RateLimit.LegacyHeaders,
+			FailClosed:    config.RateLimit.FailClosed,
+			OnDecision: func(_ *http.Request, d ratelimit.Decision) {
+				if d.Allowed {
+					rateLimitMetrics.Add(r.name+" allowed", 1)
+				} else {
+					rateLimitMetrics.Add(r.name+" rejected", 1)
+				}
+			},
+		})
+	}
+	// Requests are authenticated before their body is read
+	if config.Auth != nil {
+		policy, err := config.Auth.policy()
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+		r.handler = auth.Handler(r.handler, policy)
+	}
+	r.handler = timeout.Handler(r.handler, config.Timeouts.policy())
+	// Blocked clients are refused before anything else
+	if config.IPFilter != nil {
+		policy, err := config.IPFilter.policy()
+		if err != nil {
+			return nil, fmt.Errorf("ip filter: %w", err)
+		}
+		policy.OnMatch = func(list string, prefix netip.Prefix) {
+			cidr := "unlisted"
+			if prefix.IsValid() {
+				cidr = prefix.String()
+			}
+			ipFilterMetrics.Add(r.name+" "+list+" "+cidr, 1)
+		}
+		for _, l := range []*ipfilter.List{policy.Allow, policy.Deny} {
+			if l != nil {
+				go l.Watch(context.Background(), ipFilterReload)
+			}
+		}
+		r.handler = ipfilter.Handler(r.handler, policy)
+	}
+	return r, nil
+}
+
+// usePool sends the requests handled by h to pool
+func usePool(h http.Handler, pool *ServerPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, withPool(r, pool))
+	})
+}
+
+func (rt *router) match(path string) *route {
+	for _, r := range rt.routes {
+		if r.prefix == "/" || path == strings.TrimSuffix(r.prefix, "/") || strings.HasPrefix(path, r.prefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if route := rt.match(r.URL.Path); route != nil {
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
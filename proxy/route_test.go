@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/auth"
+	"proxy/cache"
+	"proxy/fault"
+)
+
+func TestRouter_cacheAuthenticated(t *testing.T) {
+	c, err := cache.NewCache(cache.Options{MaxBytes: 1 << 20})
+	assert.NoError(t, err)
+	next := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("data of " + r.Header.Get(auth.SubjectHeader)))
+	}))
+	pool := &ServerPool{index: -1}
+	pool.AddServer(NewServer("http://127.0.0.1:8081"))
+
+	rt := &router{splitters: map[string]*splitter{}, faults: map[string]*fault.Injector{}}
+	route, err := rt.newRoute(RouteConfig{
+		Name:     "api",
+		Timeouts: &defaultTimeouts,
+		Auth: &AuthConfig{APIKeys: &APIKeysConfig{
+			Header: "X-API-Key",
+			Keys:   map[string]string{"k1": "alice", "k2": "bob"},
+		}},
+	}, next, pools{"default": pool})
+	assert.NoError(t, err)
+
+	get := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/data", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		route.handler.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(t, "data of alice", get("k1").Body.String())
+	w := get("k2")
+	assert.Equal(t, "data of bob", w.Body.String(), "a user is not served another's response")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"proxy/shed"
+)
+
+// pressure returns the load signals of the pool: its queue depth and in-flight requests
+// against the queue limits, or against the adaptive limit, and the CPU use of the proxy
+func (s *ServerPool) pressure() []shed.Signal {
+	signals := []shed.Signal{shed.CPU()}
+	limits := upstreamLimits
+	if limits.MaxInFlight > 0 && limits.MaxQueue > 0 {
+		signals = append(signals, shed.Signal{Name: "queue", Load: func() float64 {
+			_, queued, alive := s.depth()
+			return ratio(queued, alive*limits.MaxQueue)
+		}})
+	}
+	switch {
+	case s.limiter != nil:
+		signals = append(signals, shed.Signal{Name: "in_flight", Load: func() float64 {
+			return ratio(s.limiter.InFlight(), s.limiter.Limit())
+		}})
+	case limits.MaxInFlight > 0:
+		signals = append(signals, shed.Signal{Name: "in_flight", Load: func() float64 {
+			inFlight, _, alive := s.depth()
+			return ratio(inFlight, alive*limits.MaxInFlight)
+		}})
+	}
+	return signals
+}
+
+// depth sums the requests in flight and queued over the alive servers of the pool
+func (s *ServerPool) depth() (inFlight, queued, alive int) {
+	for _, server := range s.Servers() {
+		if !server.IsAlive() {
+			continue
+		}
+		i, q := server.queue.depth()
+		inFlight, queued, alive = inFlight+i, queued+q, alive+1
+	}
+	return inFlight, queued, alive
+}
+
+func ratio(n, capacity int) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return float64(n) / float64(capacity)
+}
+
+// ShedConfig sheds the requests of a route by priority when its pool is overloaded, see shed.Policy
+type ShedConfig struct {
+	Priority string            `json:"priority"` // defaults to "normal"
+	Header   string            `json:"header"`
+	Subjects map[string]string `json:"subjects"` // priority by authenticated subject
+	// Thresholds override the loads from which priorities are shed, by priority name
+	Thresholds map[string]float64 `json:"thresholds"`
+}
+
+func (c *ShedConfig) policy(pool *ServerPool) (shed.Policy, error) {
+	p := shed.Policy{
+		Priority:   shed.Normal,
+		Header:     c.Header,
+		Subjects:   map[string]shed.Priority{},
+		Thresholds: map[shed.Priority]float64{},
+		Signals:    pool.pressure(),
+	}
+	var err error
+	if c.Priority != "" {
+		if p.Priority, err = shed.ParsePriority(c.Priority); err != nil {
+			return p, err
+		}
+	}
+	for subject, name := range c.Subjects {
+		if p.Subjects[subject], err = shed.ParsePriority(name); err != nil {
+			return p, fmt.Errorf("subject %s: %w", subject, err)
+		}
+	}
+	for priority, threshold := range shed.DefaultThresholds {
+		p.Thresholds[priority] = threshold
+	}
+	for name, threshold := range c.Thresholds {
+		priority, err := shed.ParsePriority(name)
+		if err != nil {
+			return p, err
+		}
+		p.Thresholds[priority] = threshold
+	}
+	return p, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/shed"
+)
+
+func TestServerPool_pressure(t *testing.T) {
+	defer func(limits queueLimits) { upstreamLimits = limits }(upstreamLimits)
+	upstreamLimits = queueLimits{MaxInFlight: 2, MaxQueue: 4}
+
+	pool := &ServerPool{index: -1}
+	for _, s := range []string{"http://127.0.0.1:8081", "http://127.0.0.1:8082"} {
+		pool.AddServer(NewServer(s))
+	}
+	loads := func() map[string]float64 {
+		loads := map[string]float64{}
+		for _, s := range pool.pressure() {
+			if s.Name != "cpu" {
+				loads[s.Name] = s.Load()
+			}
+		}
+		return loads
+	}
+	assert.Equal(t, map[string]float64{"queue": 0, "in_flight": 0}, loads())
+
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		_, release, err := pool.Acquire(context.Background())
+		assert.NoError(t, err)
+		releases = append(releases, release)
+	}
+	assert.Equal(t, map[string]float64{"queue": 0, "in_flight": 0.75}, loads())
+
+	// Dead servers add no capacity
+	pool.Servers()[1].SetAlive(false, pool.slowStart)
+	assert.Equal(t, 1.0, loads()["in_flight"])
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestShedConfig_policy(t *testing.T) {
+	pool := &ServerPool{index: -1}
+	policy, err := (&ShedConfig{
+		Priority:   "low",
+		Subjects:   map[string]string{"ops": "critical"},
+		Thresholds: map[string]float64{"normal": 0.6, "critical": 1.5},
+	}).policy(pool)
+	assert.NoError(t, err)
+	assert.Equal(t, shed.Low, policy.Priority)
+	assert.Equal(t, map[string]shed.Priority{"ops": shed.Critical}, policy.Subjects)
+	assert.Equal(t, map[shed.Priority]float64{shed.Low: 0.5, shed.Normal: 0.6, shed.High: 0.9, shed.Critical: 1.5}, policy.Thresholds)
+
+	_, err = (&ShedConfig{Thresholds: map[string]float64{"urgent": 0.5}}).policy(pool)
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// slowStartMinWeight is the weight a server starts with, relative to its full weight
+const slowStartMinWeight = 0.05
+
+// slowStart ramps the weight of new and recovered servers up to full over Duration,
+// linearly or exponentially. The weight is applied by ServerPool.GetServer on top of the
+// balancing strategy so the ramp works whatever the strategy is.
+type slowStart struct {
+	Duration    time.Duration
+	Exponential bool
+}
+
+// weight returns the share of its full weight a server gets after elapsed in slow start
+func (s slowStart) weight(elapsed time.Duration) float64 {
+	if s.Duration <= 0 || elapsed >= s.Duration {
+		return 1
+	}
+	progress := max(0, elapsed.Seconds()/s.Duration.Seconds())
+	if s.Exponential {
+		return slowStartMinWeight * math.Pow(1/slowStartMinWeight, progress)
+	}
+	return slowStartMinWeight + (1-slowStartMinWeight)*progress
+}
+
+// startSlowly puts the server in slow start from now on
+func (s *Server) startSlowly(slowStart slowStart) {
+	if slowStart.Duration > 0 {
+		s.warmingSince.Store(time.Now().UnixNano())
+	}
+}
+
+// weight returns the current weight of the server, between slowStartMinWeight and 1
+func (s *Server) weight(slowStart slowStart) float64 {
+	since := s.warmingSince.Load()
+	if since == 0 {
+		return 1
+	}
+	w := slowStart.weight(time.Since(time.Unix(0, since)))
+	if w >= 1 {
+		s.warmingSince.CompareAndSwap(since, 0)
+	}
+	return w
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowStart_weight(t *testing.T) {
+	tests := []struct {
+		name      string
+		slowStart slowStart
+		elapsed   time.Duration
+		want      float64
+	}{
+		{name: "disabled", slowStart: slowStart{}, elapsed: 0, want: 1},
+		{name: "linear start", slowStart: slowStart{Duration: 10 * time.Second}, elapsed: 0, want: slowStartMinWeight},
+		{name: "linear middle", slowStart: slowStart{Duration: 10 * time.Second}, elapsed: 5 * time.Second, want: slowStartMinWeight + (1-slowStartMinWeight)/2},
+		{name: "linear end", slowStart: slowStart{Duration: 10 * time.Second}, elapsed: 10 * time.Second, want: 1},
+		{name: "exponential start", slowStart: slowStart{Duration: 10 * time.Second, Exponential: true}, elapsed: 0, want: slowStartMinWeight},
+		{name: "exponential middle", slowStart: slowStart{Duration: 10 * time.Second, Exponential: true}, elapsed: 5 * time.Second, want: 0.2236},
+		{name: "exponential end", slowStart: slowStart{Duration: 10 * time.Second, Exponential: true}, elapsed: time.Minute, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, tt.slowStart.weight(tt.elapsed), 0.001)
+		})
+	}
+}
+
+func TestServerPool_GetServer(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	pool := &ServerPool{index: -1}
+	warm, cold, dead := NewServer(origin.URL), NewServer(origin.URL), NewServer(origin.URL)
+	pool.AddServer(warm)
+	pool.slowStart = slowStart{Duration: time.Hour}
+	pool.AddServer(cold)
+	pool.AddServer(dead)
+	dead.SetAlive(false, pool.slowStart)
+
+	counts := map[*Server]int{}
+	for i := 0; i < 3000; i++ {
+		counts[pool.GetServer()]++
+	}
+	assert.Zero(t, counts[dead])
+	assert.Less(t, counts[cold], 300, "a server in slow start gets a small share")
+	assert.Greater(t, counts[warm], 2700)
+
+	warm.SetAlive(false, pool.slowStart)
+	cold.SetAlive(false, pool.slowStart)
+	assert.Nil(t, pool.GetServer())
+
+	dead.SetAlive(true, pool.slowStart)
+	assert.Same(t, dead, pool.GetServer(), "a lone recovering server still gets the traffic")
+	assert.Less(t, dead.weight(pool.slowStart), 0.1)
+}
+
+func TestServer_probe(t *testing.T) {
+	status := http.StatusOK
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	server := NewServer(origin.URL)
+
+	assert.NoError(t, server.probe("/healthz", time.Second))
+	assert.NoError(t, server.probe("", time.Second))
+	status = http.StatusServiceUnavailable
+	assert.Error(t, server.probe("/healthz", time.Second))
+
+	origin.Close()
+	assert.Error(t, server.probe("", time.Second))
+}
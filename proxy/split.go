@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy/utils"
+)
+
+const (
+	stableSide = iota
+	canarySide
+)
+
+// splitStats counts the requests and server errors of one side of a split
+type splitStats struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+}
+
+func (s splitStats) errorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// splitter sends part of a route's traffic to a canary pool. Requests matching the
+// configured header or cookie always go to the canary, the others are assigned by a
+// hash of the client IP so a client stays on the same side while the percentage grows.
+//
+// When abort rules are configured, both sides' 5xx rates are compared over a tumbling
+// window and the split is aborted, sending everything back to stable, once the canary
+// does worse than allowed.
+type splitter struct {
+	route      string
+	canaryPool string
+	stable     *ServerPool
+	canary     *ServerPool
+	config     *SplitConfig
+
+	percent atomic.Uint64 // math.Float64bits of the canary percentage
+	aborted atomic.Bool
+
+	mutex       sync.Mutex
+	windowStart time.Time
+	stats       [2]splitStats
+}
+
+func newSplitter(route string, stable, canary *ServerPool, config *SplitConfig) *splitter {
+	s := &splitter{
+		route:       route,
+		canaryPool:  config.Pool,
+		stable:      stable,
+		canary:      canary,
+		config:      config,
+		windowStart: time.Now(),
+	}
+	s.setPercent(config.Percent)
+	return s
+}
+
+func (s *splitter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		side, pool := stableSide, s.stable
+		if s.toCanary(r) {
+			side, pool = canarySide, s.canary
+			r = r.WithContext(context.WithValue(r.Context(), canaryContextKey{}, true))
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, withPool(r, pool))
+		s.record(side, sw.status)
+	})
+}
+
+type canaryContextKey struct{}
+
+// cachePartition keeps the responses of the canaries apart from the stable ones in the
+// cache, so neither side gets served the other's
+func cachePartition(r *http.Request) string {
+	if canary, _ := r.Context().Value(canaryContextKey{}).(bool); canary {
+		return "canary"
+	}
+	return ""
+}
+
+func (s *splitter) toCanary(r *http.Request) bool {
+	if s.aborted.Load() {
+		return false
+	}
+	if m := s.config.Header; m != nil {
+		if v := r.Header.Get(m.Name); v != "" && (m.Value == "" || v == m.Value) {
+			return true
+		}
+	}
+	if m := s.config.Cookie; m != nil {
+		if c, err := r.Cookie(m.Name); err == nil && (m.Value == "" || c.Value == m.Value) {
+			return true
+		}
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(utils.GetRemoteIP(r)))
+	return float64(hash.Sum32()%10000) < s.Percent()*100
+}
+
+func (s *splitter) Percent() float64 {
+	return math.Float64frombits(s.percent.Load())
+}
+
+func (s *splitter) setPercent(percent float64) {
+	s.percent.Store(math.Float64bits(math.Max(0, math.Min(100, percent))))
+}
+
+// resume sets a new canary percentage, clearing a previous abort and the window stats
+func (s *splitter) resume(percent float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setPercent(percent)
+	s.stats = [2]splitStats{}
+	s.windowStart = time.Now()
+	s.aborted.Store(false)
+	log.Printf("split %s: canary %s at %.2f%%", s.route, s.canaryPool, percent)
+}
+
+func (s *splitter) record(side int, status int) {
+	isError := status >= http.StatusInternalServerError
+	prefix := s.route + ".stable_"
+	if side == canarySide {
+		prefix = s.route + ".canary_"
+	}
+	splitMetrics.Add(prefix+"requests", 1)
+	if isError {
+		splitMetrics.Add(prefix+"errors", 1)
+	}
+
+	abort := s.config.Abort
+	if abort == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if time.Since(s.windowStart) > abort.Window.Duration {
+		s.stats = [2]splitStats{}
+		s.windowStart = time.Now()
+	}
+	s.stats[side].Requests++
+	if isError {
+		s.stats[side].Errors++
+	}
+
+	canary, stable := s.stats[canarySide], s.stats[stableSide]
+	if s.aborted.Load() || canary.Requests < abort.MinRequests {
+		return
+	}
+	if delta := canary.errorRate() - stable.errorRate(); delta > abort.MaxErrorRateDelta {
+		s.aborted.Store(true)
+		s.setPercent(0)
+		splitMetrics.Add(s.route+".aborts", 1)
+		log.Printf("split %s: canary %s aborted, error rate %.2f%% vs %.2f%% on stable",
+			s.route, s.canaryPool, canary.errorRate()*100, stable.errorRate()*100)
+	}
+}
+
+// status is the splitter state returned by the admin API
+func (s *splitter) status() map[string]any {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return map[string]any{
+		"route":   s.route,
+		"pool":    s.canaryPool,
+		"percent": s.Percent(),
+		"aborted": s.aborted.Load(),
+		"stable":  s.stats[stableSide],
+		"canary":  s.stats[canarySide],
+	}
+}
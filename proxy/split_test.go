@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/cache"
+)
+
+func TestSplitter_Handler(t *testing.T) {
+	stable, canary := &ServerPool{index: -1}, &ServerPool{index: -1}
+	s := newSplitter("api", stable, canary, &SplitConfig{
+		Pool:    "canary",
+		Percent: 30,
+		Header:  &MatchConfig{Name: "X-Canary"},
+	})
+
+	var got *ServerPool
+	h := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = poolFromContext(r.Context(), nil)
+	}))
+	serve := func(ip string, header http.Header) *ServerPool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		for k, vs := range header {
+			r.Header[k] = vs
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return got
+	}
+
+	canaryClients := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		canaryClients[ip] = serve(ip, nil) == canary
+	}
+	n := 0
+	for ip, inCanary := range canaryClients {
+		// membership is sticky
+		assert.Equal(t, inCanary, serve(ip, nil) == canary, ip)
+		if inCanary {
+			n++
+		}
+	}
+	assert.InDelta(t, 300, n, 60)
+
+	// growing the percentage keeps the canary clients in the canary
+	s.resume(60)
+	for ip, inCanary := range canaryClients {
+		if inCanary {
+			assert.Equal(t, canary, serve(ip, nil), ip)
+		}
+	}
+
+	s.resume(0)
+	assert.Equal(t, stable, serve("10.0.0.1", nil))
+	assert.Equal(t, canary, serve("10.0.0.1", http.Header{"X-Canary": {"1"}}))
+}
+
+func TestSplitter_cache(t *testing.T) {
+	stable, canary := &ServerPool{index: -1}, &ServerPool{index: -1}
+	s := newSplitter("api", stable, canary, &SplitConfig{
+		Pool:   "canary",
+		Header: &MatchConfig{Name: "X-Canary"},
+	})
+	c, err := cache.NewCache(cache.Options{MaxBytes: 1 << 20, Partition: cachePartition})
+	assert.NoError(t, err)
+	h := s.Handler(c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if poolFromContext(r.Context(), nil) == canary {
+			w.Write([]byte("canary"))
+			return
+		}
+		w.Write([]byte("stable"))
+	})))
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, vs := range header {
+			r.Header[k] = vs
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	toCanary := http.Header{"X-Canary": {"1"}}
+	assert.Equal(t, "stable", serve(nil).Body.String())
+	assert.Equal(t, "canary", serve(toCanary).Body.String())
+	// Each side is then served from its own entry
+	w := serve(toCanary)
+	assert.Equal(t, "canary", w.Body.String())
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	w = serve(nil)
+	assert.Equal(t, "stable", w.Body.String())
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+}
+
+func TestSplitter_Abort(t *testing.T) {
+	stable, canary := &ServerPool{index: -1}, &ServerPool{index: -1}
+	s := newSplitter("api", stable, canary, &SplitConfig{
+		Pool:    "canary",
+		Percent: 50,
+		Abort:   &AbortConfig{MaxErrorRateDelta: 0.1, MinRequests: 20, Window: Duration{Duration: time.Minute}},
+	})
+
+	h := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if poolFromContext(r.Context(), nil) == canary {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	for i := 0; i < 200 && !s.aborted.Load(); i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	assert.True(t, s.aborted.Load())
+	assert.Equal(t, float64(0), s.Percent())
+	assert.Equal(t, int64(20), s.stats[canarySide].Requests)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy/timeout"
+)
+
+// streamHeartbeat is how long an event stream may stay silent before the proxy
+// sends a comment line to keep the client connection alive, set with --sse-heartbeat
+var streamHeartbeat = 15 * time.Second
+
+// streamWriter detects streamed responses: it flushes them after every write, which is
+// what ReverseProxy does too with a FlushInterval of -1, counts them in the "streams"
+// metrics and sends heartbeat comments on silent event streams.
+type streamWriter struct {
+	http.ResponseWriter
+	server *Server
+
+	mutex      sync.Mutex
+	streaming  bool
+	eventBound bool // the last write ended an event, a comment can be inserted
+	heartbeat  *time.Timer
+	done       bool
+}
+
+func newStreamWriter(w http.ResponseWriter, server *Server) *streamWriter {
+	return &streamWriter{ResponseWriter: w, server: server}
+}
+
+func (s *streamWriter) WriteHeader(status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.streaming && status == http.StatusOK {
+		contentType := s.Header().Get("Content-Type")
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if timeout.IsStreamingType(contentType) {
+			s.streaming = true
+			streamMetrics.Add(s.server.address, 1)
+			streamMetrics.Add("total", 1)
+			if mediaType == "text/event-stream" && streamHeartbeat > 0 {
+				s.eventBound = true
+				s.heartbeat = time.AfterFunc(streamHeartbeat, s.sendHeartbeat)
+			}
+		}
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, err := s.ResponseWriter.Write(p)
+	if s.streaming {
+		http.NewResponseController(s.ResponseWriter).Flush()
+		if s.heartbeat != nil && n > 0 {
+			s.eventBound = bytes.HasSuffix(p[:n], []byte("\n\n"))
+			s.heartbeat.Reset(streamHeartbeat)
+		}
+	}
+	return n, err
+}
+
+func (s *streamWriter) Flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *streamWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// sendHeartbeat writes an SSE comment, unless the upstream is in the middle of an event
+func (s *streamWriter) sendHeartbeat() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		return
+	}
+	if s.eventBound {
+		if _, err := s.ResponseWriter.Write([]byte(": heartbeat\n\n")); err != nil {
+			return
+		}
+		http.NewResponseController(s.ResponseWriter).Flush()
+	}
+	s.heartbeat.Reset(streamHeartbeat)
+}
+
+// close is called once the upstream response is over
+func (s *streamWriter) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.done = true
+	if s.heartbeat != nil {
+		s.heartbeat.Stop()
+	}
+	if s.streaming {
+		streamMetrics.Add(s.server.address, -1)
+	}
+}
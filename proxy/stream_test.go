@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_EventStream(t *testing.T) {
+	streamHeartbeat = 50 * time.Millisecond
+	defer func() { streamHeartbeat = 15 * time.Second }()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer origin.Close()
+
+	server := NewServer(origin.URL)
+	proxy := httptest.NewServer(server)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "1", streamMetrics.Get(server.Url.Host).String())
+
+	lines := bufio.NewScanner(resp.Body)
+	var got []string
+	for len(got) < 3 && lines.Scan() {
+		if line := strings.TrimSpace(lines.Text()); line != "" {
+			got = append(got, line)
+		}
+	}
+	// the event is received right away, then heartbeats fill the silence
+	assert.Equal(t, []string{"data: first", ": heartbeat", ": heartbeat"}, got)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unixOrigin serves h on a socket in a temporary directory, short enough for the socket path limit
+func unixOrigin(t *testing.T, h http.Handler) (*httptest.Server, string) {
+	dir, err := os.MkdirTemp("", "proxy")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "origin.sock")
+	listener, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+
+	origin := httptest.NewUnstartedServer(h)
+	origin.Listener = listener
+	origin.Start()
+	return origin, path
+}
+
+func TestServer_unixSocket(t *testing.T) {
+	origin, path := unixOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(r.Host + " " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	server := NewServer("unix://" + path)
+	proxy := httptest.NewServer(server)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/hello")
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, proxy.Listener.Addr().String()+" /hello", string(b))
+
+	// Streams are counted by socket path
+	resp, err = http.Get(proxy.URL + "/events")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", streamMetrics.Get(path).String())
+	resp.Body.Close()
+
+	assert.NoError(t, server.probe("", time.Second))
+	assert.NoError(t, server.probe("/health", time.Second))
+
+	origin.Close()
+	assert.Error(t, server.probe("", time.Second))
+	assert.Error(t, server.probe("/health", time.Second))
+}
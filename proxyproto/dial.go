@@ -0,0 +1,43 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+type addrsContextKey struct{}
+
+type addrs struct {
+	source, destination netip.AddrPort
+}
+
+// WithAddrs returns a copy of ctx carrying the client connection addresses that a Dialer
+// sends in the PROXY header of the connections dialed with the context
+func WithAddrs(ctx context.Context, source, destination netip.AddrPort) context.Context {
+	return context.WithValue(ctx, addrsContextKey{}, addrs{source, destination})
+}
+
+// Dialer sends a PROXY header of Version at the start of the connections it dials.
+// The connections carry the addresses of a single client, they mustn't be shared
+// between clients.
+type Dialer struct {
+	Dialer  *net.Dialer
+	Version int
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	h := &Header{Version: d.Version}
+	if a, ok := ctx.Value(addrsContextKey{}).(addrs); ok {
+		h.Source, h.Destination = a.source, a.destination
+	}
+	if _, err := conn.Write(h.Format()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,194 @@
+// Package proxyproto reads and writes the HAProxy PROXY protocol headers, version 1 and 2,
+// carrying the client address of connections relayed by a load balancer.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrNoHeader is returned when the connection doesn't start with a PROXY header
+	ErrNoHeader = errors.New("no PROXY protocol header")
+)
+
+const v1MaxLength = 107 // including the CRLF
+
+// Header is the content of a PROXY header. Source and Destination are invalid for the
+// connections the balancer opened itself, such as health checks.
+type Header struct {
+	Version     int
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// Read reads a PROXY header of either version from r, ErrNoHeader when there's none
+func Read(r *bufio.Reader) (*Header, error) {
+	start, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, ErrNoHeader
+	}
+	if bytes.Equal(start, v1Prefix) {
+		return readV1(r)
+	}
+	if bytes.Equal(start, v2Signature[:len(start)]) {
+		if start, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(start, v2Signature) {
+			return readV2(r)
+		}
+	}
+	return nil, ErrNoHeader
+}
+
+// readV1 reads a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	source, err1 := parseAddrPort(fields[2], fields[4])
+	destination, err2 := parseAddrPort(fields[3], fields[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q: %w", line, err)
+	}
+	if (fields[1] == "TCP4") != source.Addr().Is4() || source.Addr().Is4() != destination.Addr().Is4() {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q: address family mismatch", line)
+	}
+	h.Source, h.Destination = source, destination
+	return h, nil
+}
+
+func parseAddrPort(addr, port string) (netip.AddrPort, error) {
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(a, uint16(p)), nil
+}
+
+// readV2 reads a binary header, only the TCP and UDP over IPv4 and IPv6 addresses are
+// used, the TLVs are skipped
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("PROXY v2 header: %w", err)
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:]))
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY v2 version %d", versionCommand>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("PROXY v2 header: %w", err)
+	}
+
+	h := &Header{Version: 2}
+	switch versionCommand & 0xf {
+	case 0x0: // LOCAL
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("invalid PROXY v2 command %d", versionCommand&0xf)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		size = 4
+	case 0x2: // AF_INET6
+		size = 16
+	default: // AF_UNSPEC and AF_UNIX carry no IP address
+		return h, nil
+	}
+	if length < 2*size+4 {
+		return nil, errors.New("PROXY v2 header too short for its addresses")
+	}
+	source, _ := netip.AddrFromSlice(payload[:size])
+	destination, _ := netip.AddrFromSlice(payload[size : 2*size])
+	h.Source = netip.AddrPortFrom(source, binary.BigEndian.Uint16(payload[2*size:]))
+	h.Destination = netip.AddrPortFrom(destination, binary.BigEndian.Uint16(payload[2*size+2:]))
+	return h, nil
+}
+
+// Format returns the header in its version, the addresses must be of the same family
+// or invalid for a header without addresses
+func (h *Header) Format() []byte {
+	source, destination := h.Source, h.Destination
+	valid := source.IsValid() && destination.IsValid()
+	if valid {
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+		valid = source.Addr().Is4() == destination.Addr().Is4()
+	}
+
+	if h.Version == 1 {
+		if !valid {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if source.Addr().Is4() {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			source.Addr(), destination.Addr(), source.Port(), destination.Port()))
+	}
+
+	b := append([]byte(nil), v2Signature...)
+	if !valid {
+		return append(b, 0x20, 0x00, 0, 0) // LOCAL, AF_UNSPEC
+	}
+	family, size := byte(0x11), 4 // AF_INET, STREAM
+	if source.Addr().Is6() {
+		family, size = 0x21, 16
+	}
+	b = append(b, 0x21, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(2*size+4))
+	b = append(b, source.Addr().AsSlice()...)
+	b = append(b, destination.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, source.Port())
+	b = binary.BigEndian.AppendUint16(b, destination.Port())
+	return b
+}
+
+// addrPort returns the address of a TCP connection end
+func addrPort(addr net.Addr) netip.AddrPort {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.AddrPort()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
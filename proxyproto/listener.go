@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds the time a trusted peer has to send its PROXY header
+const headerTimeout = 5 * time.Second
+
+// Listener reads the PROXY header of the connections from the Trusted networks, their
+// RemoteAddr and LocalAddr are then the ones of the client connection the header relays.
+// A header is optional, the connections from other peers are left untouched.
+type Listener struct {
+	net.Listener
+	Trusted []netip.Prefix
+}
+
+// NewListener wraps l to accept PROXY headers from the trusted CIDRs
+func NewListener(l net.Listener, trusted []netip.Prefix) *Listener {
+	return &Listener{Listener: l, Trusted: trusted}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	// The header is read by the connection's first use, so a slow peer
+	// doesn't hold up the accept loop
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	ap := addrPort(addr)
+	for _, prefix := range l.Trusted {
+		if prefix.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted peer that may start with a PROXY header
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once        sync.Once
+	header      *Header
+	err         error
+	source      net.Addr
+	destination net.Addr
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.source, c.destination = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.header, c.err = Read(c.reader)
+		if c.err == ErrNoHeader {
+			c.err = nil
+			return
+		}
+		if c.err != nil {
+			log.Printf("proxyproto: %s: %v", c.source, c.err)
+			return
+		}
+		if c.header.Source.IsValid() {
+			c.source = net.TCPAddrFromAddrPort(c.header.Source)
+			c.destination = net.TCPAddrFromAddrPort(c.header.Destination)
+		}
+	})
+}
+
+// Header returns the PROXY header the connection started with, nil when it had none
+func (c *Conn) Header() *Header {
+	c.init()
+	return c.header
+}
+
+// NetConn returns the connection the header is read from
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	return c.source
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	return c.destination
+}
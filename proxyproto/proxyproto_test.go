@@ -0,0 +1,152 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRead(t *testing.T) {
+	v4 := &Header{Source: netip.MustParseAddrPort("192.0.2.1:56324"), Destination: netip.MustParseAddrPort("198.51.100.1:443")}
+	v6 := &Header{Source: netip.MustParseAddrPort("[2001:db8::1]:1234"), Destination: netip.MustParseAddrPort("[2001:db8::2]:80")}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    *Header
+		wantErr error
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /", want: &Header{Version: 1, Source: v4.Source, Destination: v4.Destination}},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\nGET /", want: &Header{Version: 1, Source: v6.Source, Destination: v6.Destination}},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nGET /", want: &Header{Version: 1}},
+		{name: "v2 tcp4", input: string((&Header{Version: 2, Source: v4.Source, Destination: v4.Destination}).Format()) + "GET /", want: &Header{Version: 2, Source: v4.Source, Destination: v4.Destination}},
+		{name: "v2 tcp6", input: string((&Header{Version: 2, Source: v6.Source, Destination: v6.Destination}).Format()) + "GET /", want: &Header{Version: 2, Source: v6.Source, Destination: v6.Destination}},
+		{name: "v2 local", input: string((&Header{Version: 2}).Format()) + "GET /", want: &Header{Version: 2}},
+		{name: "none", input: "GET / HTTP/1.1\r\n", wantErr: ErrNoHeader},
+		{name: "short", input: "GET", wantErr: ErrNoHeader},
+		{name: "v1 invalid address", input: "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"},
+		{name: "v1 family mismatch", input: "PROXY TCP4 2001:db8::1 2001:db8::2 1234 80\r\n"},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			got, err := Read(r)
+			if tt.want == nil {
+				assert.Error(t, err)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, "GET /", string(rest), "the connection data follows the header")
+		})
+	}
+}
+
+func TestFormat_v1(t *testing.T) {
+	h := &Header{Version: 1, Source: netip.MustParseAddrPort("[::ffff:192.0.2.1]:56324"), Destination: netip.MustParseAddrPort("198.51.100.1:443")}
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", string(h.Format()))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string((&Header{Version: 1}).Format()))
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	pl := NewListener(l, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	remoteAddrs := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	})}
+	go server.Serve(pl)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{name: "v1", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), want: "192.0.2.1:56324"},
+		{name: "v2", header: (&Header{Version: 2, Source: netip.MustParseAddrPort("[2001:db8::1]:1234"), Destination: netip.MustParseAddrPort("[2001:db8::2]:80")}).Format(), want: "[2001:db8::1]:1234"},
+		{name: "none", want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			assert.NoError(t, err)
+			defer conn.Close()
+			conn.Write(tt.header)
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+
+			got := <-remoteAddrs
+			assert.True(t, strings.HasPrefix(got, tt.want), got)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestListener_untrusted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	pl := NewListener(l, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+			conn.Close()
+		}
+	}()
+	conn, err := pl.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	b, _ := io.ReadAll(conn)
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", string(b), "untrusted peers can't spoof their address")
+	assert.True(t, strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:"))
+}
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	d := &Dialer{Dialer: &net.Dialer{}, Version: 2}
+	source, destination := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")
+	conn, err := d.DialContext(WithAddrs(context.Background(), source, destination), "tcp", l.Addr().String())
+	assert.NoError(t, err)
+	conn.Write([]byte("hello"))
+	conn.Close()
+
+	r := bufio.NewReader(bytes.NewReader(<-received))
+	h, err := Read(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Header{Version: 2, Source: source, Destination: destination}, h)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "hello", string(rest))
+}
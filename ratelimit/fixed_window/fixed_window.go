@@ -1,18 +1,123 @@
 package fixed_window
 
 import (
-	"net/http"
+	"context"
+	"sync"
 	"time"
+
+	"proxy/ratelimit"
+)
+
+// Alignment sets when the windows of a key start
+type Alignment int
+
+const (
+	// AlignClock starts the windows at the multiples of the window size: one minute windows
+	// start every minute, at the same time for all keys
+	AlignClock Alignment = iota
+	// AlignFirstRequest starts the window of a key with its first request once the
+	// previous window is over
+	AlignFirstRequest
 )
 
-var requestThrottler = newWindow(3, 100*time.Millisecond)
+// Options configure a Limiter
+type Options struct {
+	Limit  int64
+	Window time.Duration // must be positive
+	Align  Alignment
+	// EvictInterval is the period at which the windows over are removed, defaults to Window
+	EvictInterval time.Duration
+	// Now returns the current time, defaults to time.Now
+	Now func() time.Time
+}
+
+// Limiter allows Limit requests to each key within a window
+type Limiter struct {
+	options Options
+
+	mutex   sync.Mutex
+	windows map[string]*window
+	close   chan struct{}
+}
+
+// window counts the requests of a key since start
+type window struct {
+	start time.Time
+	count int64
+}
+
+// NewLimiter returns a Limiter evicting the windows over in the background, Close must be
+// called once it's not used anymore
+func NewLimiter(options Options) *Limiter {
+	if options.EvictInterval <= 0 {
+		options.EvictInterval = options.Window
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	l := &Limiter{options: options, windows: map[string]*window{}, close: make(chan struct{})}
+	go l.evictEvery(options.EvictInterval)
+	return l
+}
+
+// New returns a Limiter allowing limit requests per windowSize to each key, with windows
+// aligned to the clock
+func New(limit int64, windowSize time.Duration) ratelimit.Limiter {
+	return NewLimiter(Options{Limit: limit, Window: windowSize})
+}
+
+func (l *Limiter) Allow(_ context.Context, key string, cost int64) (ratelimit.Decision, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.options.Now()
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.start.Add(l.options.Window)) {
+		w = &window{start: now}
+		if l.options.Align == AlignClock {
+			w.start = now.Truncate(l.options.Window)
+		}
+		l.windows[key] = w
+	}
+
+	d := ratelimit.Decision{Limit: l.options.Limit, Window: l.options.Window, Reset: w.start.Add(l.options.Window)}
+	if w.count+cost <= l.options.Limit {
+		w.count += cost
+		d.Allowed = true
+	} else {
+		d.RetryAfter = d.Reset.Sub(now)
+	}
+	d.Remaining = max(0, l.options.Limit-w.count)
+	return d, nil
+}
+
+// Close stops the eviction of the windows over
+func (l *Limiter) Close() error {
+	close(l.close)
+	return nil
+}
 
-func RequestThrottler(h http.Handler, _ int64) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !requestThrottler.Allow() {
-			http.Error(w, "Reject", http.StatusTooManyRequests)
+func (l *Limiter) evictEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.close:
 			return
+		case <-ticker.C:
+			l.evict()
+		}
+	}
+}
+
+// evict removes the windows over, their keys start afresh
+func (l *Limiter) evict() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.options.Now()
+	for key, w := range l.windows {
+		if !now.Before(w.start.Add(l.options.Window)) {
+			delete(l.windows, key)
 		}
-		h.ServeHTTP(w, r)
-	})
+	}
 }
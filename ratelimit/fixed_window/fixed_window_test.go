@@ -0,0 +1,96 @@
+package fixed_window
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a time source moved forward by the tests
+type clock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		align     Alignment
+		wantReset time.Time // of the first window, the first request being 20s after start
+	}{
+		{name: "clock", align: AlignClock, wantReset: start.Add(time.Minute)},
+		{name: "first request", align: AlignFirstRequest, wantReset: start.Add(80 * time.Second)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &clock{now: start.Add(20 * time.Second)}
+			l := NewLimiter(Options{Limit: 2, Window: time.Minute, Align: test.align, Now: c.Now})
+			defer l.Close()
+			ctx := context.Background()
+
+			for want := int64(1); want >= 0; want-- {
+				d, err := l.Allow(ctx, "a", 1)
+				assert.NoError(t, err)
+				assert.True(t, d.Allowed)
+				assert.Equal(t, want, d.Remaining)
+				assert.Equal(t, test.wantReset, d.Reset)
+			}
+			c.Advance(10 * time.Second)
+			d, err := l.Allow(ctx, "a", 1)
+			assert.NoError(t, err)
+			assert.False(t, d.Allowed)
+			assert.Equal(t, test.wantReset, d.Reset)
+			assert.Equal(t, test.wantReset.Sub(c.Now()), d.RetryAfter)
+
+			// Keys have their own windows
+			d, err = l.Allow(ctx, "b", 2)
+			assert.NoError(t, err)
+			assert.True(t, d.Allowed)
+
+			c.Advance(test.wantReset.Sub(c.Now()))
+			d, err = l.Allow(ctx, "a", 1)
+			assert.NoError(t, err)
+			assert.True(t, d.Allowed, "a new window starts")
+			assert.Equal(t, int64(1), d.Remaining)
+			assert.Equal(t, test.wantReset.Add(time.Minute), d.Reset)
+		})
+	}
+}
+
+func TestLimiter_evict(t *testing.T) {
+	c := &clock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewLimiter(Options{Limit: 2, Window: time.Minute, Align: AlignFirstRequest, Now: c.Now, EvictInterval: time.Millisecond})
+	defer l.Close()
+
+	l.Allow(context.Background(), "a", 1)
+	c.Advance(30 * time.Second)
+	l.Allow(context.Background(), "b", 1)
+	windows := func() int {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return len(l.windows)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 2, windows())
+
+	c.Advance(30 * time.Second)
+	assert.Eventually(t, func() bool { return windows() == 1 }, time.Second, time.Millisecond, "the window of a is over")
+	c.Advance(30 * time.Second)
+	assert.Eventually(t, func() bool { return windows() == 0 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy/errpage"
+	"proxy/requestid"
+	"proxy/utils"
+)
+
+// Policy sets how Handler counts the requests
+type Policy struct {
+	// Key returns the key whose quota a request is taken from, the client IP by default
+	Key func(r *http.Request) string
+	// Cost returns the cost of a request, 1 by default
+	Cost func(r *http.Request) int64
+	// OnDecision is called with the decision on every request the limiter could decide
+	OnDecision func(r *http.Request, d Decision)
+	// FailClosed rejects the requests with 503 when the limiter fails, instead of letting
+	// them through
+	FailClosed bool
+	// LegacyHeaders adds the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+	// headers, the reset being a Unix timestamp, to the standard RateLimit headers
+	LegacyHeaders bool
+}
+
+// Handler answers 429 to the requests refused by limiter, the others are handled by h.
+// Requests are let through when the limiter fails, unless policy.FailClosed is set.
+func Handler(h http.Handler, limiter Limiter, policy Policy) http.Handler {
+	if policy.Key == nil {
+		policy.Key = utils.GetRemoteIP
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, cost := policy.Key(r), int64(1)
+		if policy.Cost != nil {
+			cost = policy.Cost(r)
+		}
+		d, err := limiter.Allow(r.Context(), key, cost)
+		if err != nil && policy.FailClosed {
+			errpage.Internal(w, r, http.StatusServiceUnavailable, "Rate limiter unavailable", fmt.Errorf("rate limit: %w", err))
+			return
+		}
+		if err != nil {
+			log.Printf("rate limit: %v, letting request %s through", err, requestid.Get(r))
+			h.ServeHTTP(w, r)
+			return
+		}
+		if policy.OnDecision != nil {
+			policy.OnDecision(r, d)
+		}
+		if !d.Allowed {
+			policy.writeHeaders(w.Header(), d, time.Now())
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter, 1)))
+			log.Printf("rate limit: rejected %s %s from %s, request %s", r.Method, r.URL.Path, key, requestid.Get(r))
+			errpage.Write(w, r, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		h.ServeHTTP(&headerWriter{ResponseWriter: w, policy: policy, decision: d}, r)
+	})
+}
+
+// headerWriter sets the RateLimit headers on the response once it's written, replacing
+// any set upstream. Set earlier, they would end up in the cached responses.
+type headerWriter struct {
+	http.ResponseWriter
+	policy      Policy
+	decision    Decision
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.policy.writeHeaders(w.ResponseWriter.Header(), w.decision, time.Now())
+		w.wroteHeader = status >= 200
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeHeaders sets the RateLimit headers of draft-ietf-httpapi-ratelimit-headers
+func (p Policy) writeHeaders(header http.Header, d Decision, now time.Time) {
+	limit, remaining := strconv.FormatInt(d.Limit, 10), strconv.FormatInt(d.Remaining, 10)
+	reset := seconds(d.Reset.Sub(now), 0)
+	header.Set("RateLimit-Limit", limit)
+	header.Set("RateLimit-Remaining", remaining)
+	header.Set("RateLimit-Reset", strconv.Itoa(reset))
+	if d.Window > 0 {
+		header.Set("RateLimit-Policy", limit+";w="+strconv.Itoa(seconds(d.Window, 1)))
+	}
+	if p.LegacyHeaders {
+		header.Set("X-RateLimit-Limit", limit)
+		header.Set("X-RateLimit-Remaining", remaining)
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+int64(reset), 10))
+	}
+}
+
+// seconds rounds d up to whole seconds, and never returns less than least
+func seconds(d time.Duration, least int) int {
+	return max(least, int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_writeHeaders(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	header := http.Header{}
+	Policy{LegacyHeaders: true}.writeHeaders(header, Decision{
+		Limit:     100,
+		Window:    90 * time.Second,
+		Remaining: 0,
+		Reset:     now.Add(2500 * time.Millisecond),
+	}, now)
+	assert.Equal(t, http.Header{
+		"Ratelimit-Limit":       {"100"},
+		"Ratelimit-Remaining":   {"0"},
+		"Ratelimit-Reset":       {"3"},
+		"Ratelimit-Policy":      {"100;w=90"},
+		"X-Ratelimit-Limit":     {"100"},
+		"X-Ratelimit-Remaining": {"0"},
+		"X-Ratelimit-Reset":     {"1700000003"},
+	}, header)
+
+	// A reset in the past is now
+	header = http.Header{}
+	Policy{}.writeHeaders(header, Decision{Limit: 100, Remaining: 100, Reset: now.Add(-time.Second)}, now)
+	assert.Equal(t, "0", header.Get("RateLimit-Reset"))
+	assert.Empty(t, header.Get("RateLimit-Policy"))
+}
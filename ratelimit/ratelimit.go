@@ -1,7 +1,29 @@
-package algorithm
+// Package ratelimit defines the interface of the rate limiting algorithms of its
+// subpackages, and the HTTP middleware enforcing any of them.
+package ratelimit
 
-import "net/http"
+import (
+	"context"
+	"time"
+)
 
+// Limiter decides whether the requests of a key fit in its quota
 type Limiter interface {
-	RequestThrottler(h http.Handler, maxRequests int) http.Handler
+	// Allow takes cost from the quota of key when there's enough left. The error is set
+	// when the limiter state couldn't be read or updated, the decision is then meaningless.
+	Allow(ctx context.Context, key string, cost int64) (Decision, error)
+}
+
+// Decision is the outcome of Allow
+type Decision struct {
+	Allowed bool
+	// Limit is the quota of a key over Window
+	Limit  int64
+	Window time.Duration
+	// Remaining is what's left of the quota once the request is counted
+	Remaining int64
+	// Reset is when the quota will be whole again, given no more requests
+	Reset time.Time
+	// RetryAfter is how long to wait before the request would be allowed, when it isn't
+	RetryAfter time.Duration
 }
@@ -0,0 +1,162 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/ratelimit"
+	"proxy/ratelimit/fixed_window"
+	"proxy/ratelimit/sliding_log"
+	"proxy/ratelimit/sliding_window"
+	"proxy/ratelimit/token_bucket"
+)
+
+func TestLimiters(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter ratelimit.Limiter
+	}{
+		{name: "fixed window", limiter: fixed_window.New(3, time.Minute)},
+		{name: "sliding window", limiter: sliding_window.New(3, time.Minute)},
+		{name: "sliding log", limiter: sliding_log.NewSlidingLogLimiter(time.Minute, 3)},
+		{name: "token bucket", limiter: token_bucket.New(3, time.Minute)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			start := time.Now()
+			for want := int64(2); want >= 1; want-- {
+				d, err := test.limiter.Allow(ctx, "a", 1)
+				assert.NoError(t, err)
+				assert.True(t, d.Allowed)
+				assert.Equal(t, int64(3), d.Limit)
+				assert.Equal(t, want, d.Remaining)
+				assert.Zero(t, d.RetryAfter)
+			}
+
+			// Too costly for what's left
+			d, err := test.limiter.Allow(ctx, "a", 2)
+			assert.NoError(t, err)
+			assert.False(t, d.Allowed)
+			assert.Equal(t, int64(1), d.Remaining)
+
+			d, err = test.limiter.Allow(ctx, "a", 1)
+			assert.NoError(t, err)
+			assert.True(t, d.Allowed)
+			assert.Zero(t, d.Remaining)
+
+			d, err = test.limiter.Allow(ctx, "a", 1)
+			assert.NoError(t, err)
+			assert.False(t, d.Allowed)
+			assert.Zero(t, d.Remaining)
+			assert.Greater(t, d.RetryAfter, time.Duration(0))
+			assert.LessOrEqual(t, d.RetryAfter, 2*time.Minute)
+			assert.True(t, d.Reset.After(start))
+			assert.True(t, d.Reset.Before(start.Add(2*time.Minute+time.Second)))
+
+			d, err = test.limiter.Allow(ctx, "b", 1)
+			assert.NoError(t, err)
+			assert.True(t, d.Allowed)
+		})
+	}
+}
+
+type fakeLimiter struct {
+	keys []string
+	d    ratelimit.Decision
+	err  error
+}
+
+func (f *fakeLimiter) Allow(_ context.Context, key string, cost int64) (ratelimit.Decision, error) {
+	f.keys = append(f.keys, key)
+	return f.d, f.err
+}
+
+func TestHandler(t *testing.T) {
+	reset := time.Now().Add(1500 * time.Millisecond)
+	tests := []struct {
+		name        string
+		decision    ratelimit.Decision
+		err         error
+		legacy      bool
+		failClosed  bool
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "allowed",
+			decision:   ratelimit.Decision{Allowed: true, Limit: 10, Window: time.Minute, Remaining: 7, Reset: reset},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "7",
+				"RateLimit-Reset":     "2",
+				"RateLimit-Policy":    "10;w=60",
+				"X-RateLimit-Limit":   "",
+				"Retry-After":         "",
+				"X-Upstream":          "kept",
+			},
+		},
+		{
+			name:       "legacy headers",
+			decision:   ratelimit.Decision{Allowed: true, Limit: 10, Window: time.Second, Remaining: 7, Reset: reset},
+			legacy:     true,
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"RateLimit-Limit":       "10",
+				"RateLimit-Policy":      "10;w=1",
+				"X-RateLimit-Limit":     "10",
+				"X-RateLimit-Remaining": "7",
+			},
+		},
+		{
+			name:       "rejected",
+			decision:   ratelimit.Decision{Limit: 10, Window: time.Minute, Reset: reset, RetryAfter: 200 * time.Millisecond},
+			wantStatus: http.StatusTooManyRequests,
+			wantHeaders: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "2",
+				"Retry-After":         "1",
+				"X-Upstream":          "",
+			},
+		},
+		{
+			name:        "limiter failure, closed",
+			err:         errors.New("store unavailable"),
+			failClosed:  true,
+			wantStatus:  http.StatusServiceUnavailable,
+			wantHeaders: map[string]string{"RateLimit-Limit": "", "X-Upstream": ""},
+		},
+		{
+			name:        "limiter failure",
+			err:         errors.New("store unavailable"),
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"RateLimit-Limit": "1000", "X-Upstream": "kept"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := &fakeLimiter{d: test.decision, err: test.err}
+			h := ratelimit.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("RateLimit-Limit", "1000")
+				w.Header().Set("X-Upstream", "kept")
+				w.Write([]byte("ok"))
+			}), limiter, ratelimit.Policy{LegacyHeaders: test.legacy, FailClosed: test.failClosed})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, test.wantStatus, w.Code)
+			assert.Equal(t, []string{"192.0.2.1"}, limiter.keys)
+			for name, want := range test.wantHeaders {
+				assert.Equal(t, want, w.Header().Get(name), name)
+			}
+		})
+	}
+}
@@ -1,13 +1,15 @@
 package sliding_log
 
 import (
-	"fmt"
-	"net"
-	"net/http"
+	"context"
 	"sync"
 	"time"
+
+	"proxy/ratelimit"
 )
 
+// SlidingLogLimiter logs the time of every request of each host, a host is limited to
+// maxRequests within the last interval
 type SlidingLogLimiter struct {
 	mu          sync.RWMutex
 	hostLog     map[string][]time.Time
@@ -23,53 +25,46 @@ func NewSlidingLogLimiter(interval time.Duration, maxRequests int) *SlidingLogLi
 	}
 }
 
+// Halt tells whether a request of host must be rejected, it's logged otherwise
 func (sll *SlidingLogLimiter) Halt(host string) bool {
+	d, _ := sll.Allow(context.Background(), host, 1)
+	return !d.Allowed
+}
+
+// Allow logs cost requests of host unless there would then be more than maxRequests
+// within the last interval
+func (sll *SlidingLogLimiter) Allow(_ context.Context, host string, cost int64) (ratelimit.Decision, error) {
 	sll.mu.Lock()
 	defer sll.mu.Unlock()
 
 	now := time.Now()
-	_, ok := sll.hostLog[host]
-	if !ok {
-		sll.hostLog[host] = []time.Time{now}
-		return false
+	// Drop the requests older than interval, the log is in chronological order
+	hostLog := sll.hostLog[host]
+	expired := 0
+	for expired < len(hostLog) && hostLog[expired].Before(now.Add(-sll.interval)) {
+		expired++
 	}
+	hostLog = hostLog[expired:]
 
-	// Đếm số request trong thời gian tính từ thời điểm gọi đến trước đó 1 khoảng thời gian bằng cách duyệt từ cuối hostLog
-	requestCount := 0
-	timestamp := now.Add(-sll.interval)
-	newTs := sll.hostLog[host][:0]
-	for i := len(sll.hostLog[host]) - 1; i >= 0; i-- {
-		t := sll.hostLog[host][i]
-		if !t.Before(timestamp) {
-			newTs = append(newTs, t)
-			requestCount++
-		} else {
-			break
+	d := ratelimit.Decision{Limit: int64(sll.maxRequests), Window: sll.interval, Reset: now}
+	if excess := len(hostLog) + int(cost) - sll.maxRequests; excess > 0 {
+		// The request fits once the excess oldest requests are out of the interval
+		d.RetryAfter = sll.interval
+		if excess <= len(hostLog) {
+			d.RetryAfter = hostLog[excess-1].Add(sll.interval).Sub(now)
 		}
+	} else {
+		for i := int64(0); i < cost; i++ {
+			hostLog = append(hostLog, now)
+		}
+		d.Allowed = true
 	}
-	sll.hostLog[host] = newTs
-
-	fmt.Printf("Number of requests within the last %.0f seconds: %d\n", sll.interval.Seconds(), requestCount)
-	fmt.Printf("Max request in %.0f seconds: %d\n", sll.interval.Seconds(), sll.maxRequests)
-
-	// Nếu vượt quá số request max thì trả về too many request
-	if requestCount >= sll.maxRequests {
-		return true
+	if len(hostLog) == 0 {
+		delete(sll.hostLog, host)
+	} else {
+		sll.hostLog[host] = hostLog
+		d.Reset = hostLog[len(hostLog)-1].Add(sll.interval)
 	}
-
-	sll.hostLog[host] = append(sll.hostLog[host], now)
-	return false
-}
-
-func RequestThrottlerMiddleware(h http.Handler, maxRequests int) http.Handler {
-	throttler := NewSlidingLogLimiter(10*time.Second, maxRequests)
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host, _, _ := net.SplitHostPort(r.RemoteAddr)
-		if throttler.Halt(host) {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			return
-		}
-		h.ServeHTTP(w, r)
-	})
+	d.Remaining = int64(max(0, sll.maxRequests-len(hostLog)))
+	return d, nil
 }
@@ -53,6 +53,18 @@ func (m *localStore) inc(key string, window time.Time) error {
 	return nil
 }
 
+// add adds n to current window limit counter for key and returns both counters
+func (m *localStore) add(key string, previousWindow, currentWindow time.Time, n int64) (prevValue int64, currValue int64, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	data := m.data[mapKey(key, currentWindow)]
+	data.val += n
+	data.lastUpdate = time.Now().UTC()
+	m.data[mapKey(key, currentWindow)] = data
+	return m.data[mapKey(key, previousWindow)].val, data.val, nil
+}
+
 // Get gets value of previous window counter and current window counter for key
 func (m *localStore) get(key string, previousWindow, currentWindow time.Time) (prevValue int64, currValue int64, err error) {
 	m.mutex.RLock()
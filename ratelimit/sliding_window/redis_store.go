@@ -0,0 +1,289 @@
+package sliding_window
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisOptions locate the Redis server sharing the counters of several proxies
+type RedisOptions struct {
+	Addr     string // host:port
+	Password string
+	DB       int
+	// KeyPrefix is put before the counter keys, defaults to "ratelimit:"
+	KeyPrefix string
+	// Timeout bounds dialing and every exchange with the server, defaults to 100ms
+	Timeout time.Duration
+	// PoolSize is the number of idle connections kept open, defaults to 10
+	PoolSize int
+}
+
+// redisStore keeps the counters in Redis, or any server speaking its protocol (RESP),
+// so that all the proxies using it enforce the same limit. Counters expire expirationTime
+// after their last increment.
+type redisStore struct {
+	options        RedisOptions
+	expirationTime time.Duration
+	idle           chan *redisConn
+}
+
+func newRedisStore(options RedisOptions, expirationTime time.Duration) *redisStore {
+	if options.KeyPrefix == "" {
+		options.KeyPrefix = "ratelimit:"
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 100 * time.Millisecond
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = 10
+	}
+	return &redisStore{
+		options:        options,
+		expirationTime: expirationTime,
+		idle:           make(chan *redisConn, options.PoolSize),
+	}
+}
+
+// inc increments the counter and sets its expiration in a single transaction
+func (s *redisStore) inc(key string, window time.Time) error {
+	k := s.options.KeyPrefix + mapKey(key, window)
+	replies, err := s.do(
+		[]string{"MULTI"},
+		[]string{"INCR", k},
+		[]string{"PEXPIRE", k, strconv.FormatInt(s.expirationTime.Milliseconds(), 10)},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return err
+	}
+	exec, ok := replies[3].([]any)
+	if !ok || len(exec) != 2 {
+		return fmt.Errorf("redis: unexpected EXEC reply %v", replies[3])
+	}
+	for _, reply := range exec {
+		if err, ok := reply.(redisError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// add reads the previous counter, adds n to the current one and sets its expiration in
+// a single transaction, so that the replicas sharing the counters see each other's additions
+func (s *redisStore) add(key string, previousWindow, currentWindow time.Time, n int64) (prevValue int64, currValue int64, err error) {
+	k := s.options.KeyPrefix + mapKey(key, currentWindow)
+	replies, err := s.do(
+		[]string{"MULTI"},
+		[]string{"GET", s.options.KeyPrefix + mapKey(key, previousWindow)},
+		[]string{"INCRBY", k, strconv.FormatInt(n, 10)},
+		[]string{"PEXPIRE", k, strconv.FormatInt(s.expirationTime.Milliseconds(), 10)},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	exec, ok := replies[4].([]any)
+	if !ok || len(exec) != 3 {
+		return 0, 0, fmt.Errorf("redis: unexpected EXEC reply %v", replies[4])
+	}
+	for _, reply := range exec {
+		if err, ok := reply.(redisError); ok {
+			return 0, 0, err
+		}
+	}
+	if prevValue, err = counter(exec[0]); err != nil {
+		return 0, 0, err
+	}
+	if currValue, ok = exec[1].(int64); !ok {
+		return 0, 0, fmt.Errorf("redis: unexpected INCRBY reply %v", exec[1])
+	}
+	return prevValue, currValue, nil
+}
+
+// get reads both counters in one round trip
+func (s *redisStore) get(key string, previousWindow, currentWindow time.Time) (prevValue int64, currValue int64, err error) {
+	replies, err := s.do(
+		[]string{"GET", s.options.KeyPrefix + mapKey(key, previousWindow)},
+		[]string{"GET", s.options.KeyPrefix + mapKey(key, currentWindow)},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	if prevValue, err = counter(replies[0]); err != nil {
+		return 0, 0, err
+	}
+	if currValue, err = counter(replies[1]); err != nil {
+		return 0, 0, err
+	}
+	return prevValue, currValue, nil
+}
+
+// counter parses the reply to GET, a missing key counts 0
+func counter(reply any) (int64, error) {
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("redis: unexpected GET reply %v", reply)
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do pipelines commands over one connection and returns their replies. Error replies
+// fail the whole call.
+func (s *redisStore) do(commands ...[]string) ([]any, error) {
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.do(s.options.Timeout, commands...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			// The connection is still usable after an error reply
+			s.release(conn)
+			return nil, err
+		}
+	}
+	s.release(conn)
+	return replies, nil
+}
+
+// conn returns an idle connection, or a new one
+func (s *redisStore) conn() (*redisConn, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+	c, err := net.DialTimeout("tcp", s.options.Addr, s.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, reader: bufio.NewReader(c)}
+	var setup [][]string
+	if s.options.Password != "" {
+		setup = append(setup, []string{"AUTH", s.options.Password})
+	}
+	if s.options.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.options.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := conn.do(s.options.Timeout, setup...)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(redisError); ok {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *redisStore) release(conn *redisConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// do writes the commands at once and reads as many replies
+func (c *redisConn) do(timeout time.Duration, commands ...[]string) ([]any, error) {
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var b []byte
+	for _, args := range commands {
+		b = append(b, '*')
+		b = strconv.AppendInt(b, int64(len(args)), 10)
+		b = append(b, "\r\n"...)
+		for _, arg := range args {
+			b = append(b, '$')
+			b = strconv.AppendInt(b, int64(len(arg)), 10)
+			b = append(b, "\r\n"...)
+			b = append(b, arg...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(commands))
+	for i := range replies {
+		reply, err := readReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readReply reads a RESP reply: a string, redisError, int64, nil, or []any
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return redisError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elements := make([]any, n)
+		for i := range elements {
+			if elements[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,257 @@
+package sliding_window
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/ratelimit"
+)
+
+// respServer is an in-process stand-in of a Redis server, knowing the commands of redisStore
+type respServer struct {
+	net.Listener
+	password string
+
+	mutex   sync.Mutex
+	data    map[string]int64
+	ttls    map[string]int64 // milliseconds
+	batches []string         // commands received together, separated by spaces
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &respServer{Listener: listener, password: password, data: map[string]int64{}, ttls: map[string]int64{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authenticated := s.password == ""
+	var queued [][]string
+	var batch []string
+	for {
+		command, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range command.([]any) {
+			args = append(args, arg.(string))
+		}
+		name := strings.ToUpper(args[0])
+		batch = append(batch, name)
+
+		var reply any
+		switch {
+		case name == "AUTH":
+			authenticated = args[1] == s.password
+			reply = "OK"
+			if !authenticated {
+				reply = redisError("WRONGPASS invalid password")
+			}
+		case !authenticated:
+			reply = redisError("NOAUTH Authentication required.")
+		case name == "MULTI":
+			queued, reply = [][]string{}, "OK"
+		case name == "EXEC":
+			// The transaction runs without interleaving the commands of other connections
+			var replies []any
+			s.mutex.Lock()
+			for _, args := range queued {
+				replies = append(replies, s.exec(args))
+			}
+			s.mutex.Unlock()
+			queued, reply = nil, replies
+		case queued != nil:
+			queued, reply = append(queued, args), "QUEUED"
+		default:
+			s.mutex.Lock()
+			reply = s.exec(args)
+			s.mutex.Unlock()
+		}
+		writeReply(w, reply)
+
+		if r.Buffered() == 0 {
+			s.mutex.Lock()
+			s.batches = append(s.batches, strings.Join(batch, " "))
+			s.mutex.Unlock()
+			batch = nil
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec runs a command, with the mutex held
+func (s *respServer) exec(args []string) any {
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "OK"
+	case "GET":
+		if v, ok := s.data[args[1]]; ok {
+			return []byte(strconv.FormatInt(v, 10))
+		}
+		return nil
+	case "INCR":
+		s.data[args[1]]++
+		return s.data[args[1]]
+	case "INCRBY":
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		s.data[args[1]] += n
+		return s.data[args[1]]
+	case "PEXPIRE":
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		s.ttls[args[1]] = ms
+		return int64(1)
+	}
+	return redisError("ERR unknown command")
+}
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		w.WriteString("+" + v + "\r\n")
+	case redisError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+func (s *respServer) takeBatches() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	batches := s.batches
+	s.batches = nil
+	return batches
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newRESPServer(t, "secret")
+	options := RedisOptions{Addr: server.Addr().String(), Password: "secret", DB: 2}
+	replica1 := newRedisStore(options, 2*time.Second)
+	replica2 := newRedisStore(options, 2*time.Second)
+
+	window := time.Now().UTC().Truncate(time.Second)
+	previous := window.Add(-time.Second)
+	assert.NoError(t, replica1.inc("a", window))
+	assert.NoError(t, replica1.inc("a", previous))
+	assert.NoError(t, replica2.inc("a", window))
+
+	prevValue, currValue, err := replica2.get("a", previous, window)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), prevValue)
+	assert.Equal(t, int64(2), currValue)
+	prevValue, currValue, err = replica1.get("b", previous, window)
+	assert.NoError(t, err)
+	assert.Zero(t, prevValue)
+	assert.Zero(t, currValue)
+	prevValue, currValue, err = replica1.add("a", previous, window, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), prevValue)
+	assert.Equal(t, int64(5), currValue)
+
+	assert.Equal(t, map[string]int64{
+		"ratelimit:" + mapKey("a", window):   2000,
+		"ratelimit:" + mapKey("a", previous): 2000,
+	}, server.ttls)
+	// A connection per replica is set up, then reused. The increments are transactions,
+	// the reads are pipelined, an addition reads the previous counter in its transaction.
+	assert.Equal(t, []string{
+		"AUTH SELECT", "MULTI INCR PEXPIRE EXEC",
+		"MULTI INCR PEXPIRE EXEC",
+		"AUTH SELECT", "MULTI INCR PEXPIRE EXEC",
+		"GET GET",
+		"GET GET",
+		"MULTI GET INCRBY PEXPIRE EXEC",
+	}, server.takeBatches())
+
+	_, _, err = newRedisStore(RedisOptions{Addr: server.Addr().String(), Password: "wrong"}, time.Second).get("a", previous, window)
+	assert.ErrorContains(t, err, "WRONGPASS")
+	_, _, err = newRedisStore(RedisOptions{Addr: server.Addr().String()}, time.Second).get("a", previous, window)
+	assert.ErrorContains(t, err, "NOAUTH")
+}
+
+func TestNewRedis(t *testing.T) {
+	server := newRESPServer(t, "")
+	options := RedisOptions{Addr: server.Addr().String()}
+	replica1 := NewRedis(3, time.Minute, options)
+	replica2 := NewRedis(3, time.Minute, options)
+
+	ctx := context.Background()
+	for _, limiter := range []ratelimit.Limiter{replica1, replica2, replica1} {
+		d, err := limiter.Allow(ctx, "a", 1)
+		assert.NoError(t, err)
+		assert.True(t, d.Allowed)
+	}
+	d, err := replica2.Allow(ctx, "a", 1)
+	assert.NoError(t, err)
+	assert.False(t, d.Allowed, "the limit is shared by the replicas")
+
+	server.Close()
+	unreachable := NewRedis(3, time.Minute, RedisOptions{Addr: server.Addr().String(), Timeout: 50 * time.Millisecond})
+	_, err = unreachable.Allow(ctx, "a", 1)
+	assert.Error(t, err)
+}
+
+func TestNewRedis_concurrent(t *testing.T) {
+	server := newRESPServer(t, "")
+	options := RedisOptions{Addr: server.Addr().String(), Timeout: time.Second}
+	var replicas []ratelimit.Limiter
+	for i := 0; i < 4; i++ {
+		replicas = append(replicas, NewRedis(10, time.Hour, options))
+	}
+
+	// The replicas race for the last units of the limit, with requests costing 1 and 2
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(limiter ratelimit.Limiter, cost int64) {
+			defer wg.Done()
+			d, err := limiter.Allow(context.Background(), "a", cost)
+			assert.NoError(t, err)
+			if d.Allowed {
+				allowed.Add(cost)
+			}
+		}(replicas[i%len(replicas)], int64(1+i%2))
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, allowed.Load(), int64(10), "the replicas don't overshoot the limit")
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	assert.Equal(t, allowed.Load(), server.data["ratelimit:"+mapKey("a", time.Now().UTC().Truncate(time.Hour))], "refused requests are uncounted")
+}
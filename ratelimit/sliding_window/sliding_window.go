@@ -1,38 +1,22 @@
 package sliding_window
 
 import (
-	"log"
-	"net/http"
-	"proxy/utils"
 	"time"
-)
 
-var (
-	windowSize  = time.Second
-	windowStore = newLocalStore(2*windowSize, 100*time.Millisecond)
+	"proxy/ratelimit"
 )
 
-func RequestThrottler(h http.Handler, maxAmount int64) http.Handler {
-	requestThrottler := newWindow(windowStore, maxAmount, windowSize)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		remoteIP := utils.GetRemoteIP(r)
-		//key := fmt.Sprintf("%s_%s_%s", remoteIP, r.URL.String(), r.Method)
+// flushInterval is the period at which the expired counters are removed from the local store
+const flushInterval = 100 * time.Millisecond
 
-		limitStatus, err := requestThrottler.Halt(remoteIP)
-		if err != nil {
-			// if rate limit error then pass the request
-			h.ServeHTTP(w, r)
-		}
-		if limitStatus.IsLimited {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			return
-		}
-
-		if err := requestThrottler.inc(remoteIP); err != nil {
-			log.Printf("could not increment key: %s", remoteIP)
-		}
+// New returns a limiter allowing limit requests per windowSize to each key, with the
+// counters kept in memory
+func New(limit int64, windowSize time.Duration) ratelimit.Limiter {
+	return newWindow(newLocalStore(2*windowSize, flushInterval), limit, windowSize)
+}
 
-		h.ServeHTTP(w, r)
-	})
+// NewRedis returns a limiter allowing limit requests per windowSize to each key, with the
+// counters shared by all the proxies using the Redis server of options
+func NewRedis(limit int64, windowSize time.Duration, options RedisOptions) ratelimit.Limiter {
+	return newWindow(newRedisStore(options, 2*windowSize), limit, windowSize)
 }
@@ -8,6 +8,9 @@ import "time"
 type store interface {
 	// inc increments current window limit counter for key
 	inc(key string, window time.Time) error
+	// add adds n to current window limit counter for key and returns the previous window
+	// counter with the current one after the addition, as a single atomic operation
+	add(key string, previousWindow, currentWindow time.Time, n int64) (prevValue int64, currValue int64, err error)
 	// get gets value of previous window counter and current window counter for key
 	get(key string, previousWindow, currentWindow time.Time) (prevValue int64, currValue int64, err error)
 }
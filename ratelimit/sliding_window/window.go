@@ -1,7 +1,11 @@
 package sliding_window
 
 import (
+	"context"
+	"math"
 	"time"
+
+	"proxy/ratelimit"
 )
 
 // simple rate-limiter for any resources inspired by Cloudflare's approach: https://blog.cloudflare.com/counting-things-a-lot-of-different-things/
@@ -89,3 +93,40 @@ func (r *window) calcLimitDuration(prevValue, currValue int64, timeFromCurrWindo
 	}
 	return limitDuration
 }
+
+// Allow counts cost requests for key unless the rate would then exceed the limit. The
+// requests are counted before the rate is checked, and uncounted when they're refused, so
+// that concurrent calls sharing a store can't all see room for their requests.
+func (w *window) Allow(_ context.Context, key string, cost int64) (ratelimit.Decision, error) {
+	now := time.Now().UTC()
+	currentSize := now.Truncate(w.windowSize)
+	previousSize := currentSize.Add(-w.windowSize)
+	prevValue, currentValue, err := w.windowStore.add(key, previousSize, currentSize, cost)
+	if err != nil {
+		return ratelimit.Decision{}, err
+	}
+	// The rate before these requests, the ones counted after them don't weigh on the decision
+	currentValue -= cost
+	timeFromCurrWindow := now.Sub(currentSize)
+	rate := w.calcRate(timeFromCurrWindow, prevValue, currentValue)
+
+	// The requests of the current window weigh on the rate until the end of the next one
+	d := ratelimit.Decision{Limit: w.maxAmount, Window: w.windowSize, Reset: currentSize.Add(2 * w.windowSize)}
+	if rate+float64(cost) > float64(w.maxAmount) {
+		if _, _, err := w.windowStore.add(key, previousSize, currentSize, -cost); err != nil {
+			return ratelimit.Decision{}, err
+		}
+		d.Remaining = max(0, int64(math.Floor(float64(w.maxAmount)-rate)))
+		// cost requests fit once the rate falls under maxAmount-cost+1
+		target := &window{windowSize: w.windowSize, maxAmount: w.maxAmount - cost + 1}
+		d.RetryAfter = target.calcLimitDuration(prevValue, currentValue, timeFromCurrWindow)
+		if d.RetryAfter <= 0 {
+			// The cost is over the limit, it's never allowed
+			d.RetryAfter = w.windowSize
+		}
+		return d, nil
+	}
+	d.Allowed = true
+	d.Remaining = max(0, int64(math.Floor(float64(w.maxAmount)-rate-float64(cost))))
+	return d, nil
+}
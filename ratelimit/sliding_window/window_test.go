@@ -1,6 +1,7 @@
 package sliding_window
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -143,3 +144,22 @@ func TestRateLimiter_calcRate(t *testing.T) {
 		assert.Equal(t, tt.want, rate)
 	}
 }
+
+func TestRateLimiter_Allow(t *testing.T) {
+	store := newLocalStore(1*time.Hour, 1*time.Hour)
+	r := newWindow(store, 2, time.Hour)
+	for i := 0; i < 2; i++ {
+		d, err := r.Allow(context.Background(), "a", 1)
+		assert.NoError(t, err)
+		assert.True(t, d.Allowed)
+	}
+	d, err := r.Allow(context.Background(), "a", 1)
+	assert.NoError(t, err)
+	assert.False(t, d.Allowed)
+
+	// Retry-After is the time until the rate falls under the limit
+	status, err := r.Halt("a")
+	assert.NoError(t, err)
+	assert.True(t, status.IsLimited)
+	assert.InDelta(t, *status.LimitDuration, d.RetryAfter, float64(time.Second))
+}
@@ -28,6 +28,7 @@ func newBucket(maxAmount int64, refillTime time.Duration) *bucket {
 		maxAmount: maxAmount,
 		close:     make(chan struct{}),
 	}
+	fill := refillTime != -1
 
 	if evenRefillTime := time.Duration(1e9 / maxAmount); refillTime < evenRefillTime {
 		refillTime = evenRefillTime
@@ -36,7 +37,7 @@ func newBucket(maxAmount int64, refillTime time.Duration) *bucket {
 	b.refillAmount = int64(math.Floor(.5 + (float64(maxAmount) * refillTime.Seconds())))
 	b.refillTime = refillTime
 
-	if refillTime == -1 {
+	if !fill {
 		return b
 	}
 
@@ -1,6 +1,7 @@
 package token_bucket
 
 import (
+	"math"
 	"sync"
 	"time"
 )
@@ -10,6 +11,7 @@ import (
 type throttler struct {
 	mutex      sync.RWMutex       // mutex to protect the buckets map
 	refillTime time.Duration      // the amount of time between refills of each bucket
+	window     time.Duration      // the time over which buckets are refilled with their maxAmount
 	buckets    map[string]*bucket // the map of buckets
 	close      chan struct{}      // trigger channel to close the throttler
 }
@@ -23,6 +25,7 @@ type throttler struct {
 func newThrottler(refillTime time.Duration) *throttler {
 	th := &throttler{
 		refillTime: refillTime,
+		window:     time.Second,
 		buckets:    map[string]*bucket{},
 		close:      make(chan struct{}),
 	}
@@ -50,6 +53,10 @@ func (t *throttler) Bucket(key string, maxAmount int64) *bucket {
 		// -1 param means no filling go-routine for this bucket
 		// because it's already handled by the throttler's single filling go-routine
 		b = newBucket(maxAmount, -1)
+		if t.refillTime > 0 {
+			b.refillTime = t.refillTime
+			b.refillAmount = max(1, int64(math.Floor(.5+float64(maxAmount)*t.refillTime.Seconds()/t.window.Seconds())))
+		}
 		t.buckets[key] = b
 	}
 
@@ -1,22 +1,49 @@
 package token_bucket
 
 import (
-	"net"
-	"net/http"
+	"context"
+	"sync/atomic"
 	"time"
+
+	"proxy/ratelimit"
 )
 
-var requestThrottler = newThrottler(100 * time.Millisecond) // refill every 100ms = 10req/s
+// minRefillTime bounds the rate of the filling go-routine of a Limiter
+const minRefillTime = 10 * time.Millisecond
+
+// Limiter gives every key a bucket of limit tokens, refilled with limit tokens per window.
+// A request takes as many tokens as its cost.
+type Limiter struct {
+	throttler *throttler
+	limit     int64
+}
+
+// New returns a Limiter of a positive limit, Close must be called once it's not used anymore
+func New(limit int64, window time.Duration) *Limiter {
+	th := newThrottler(max(window/time.Duration(limit), minRefillTime))
+	th.window = window
+	return &Limiter{throttler: th, limit: limit}
+}
+
+func (l *Limiter) Allow(_ context.Context, key string, cost int64) (ratelimit.Decision, error) {
+	b := l.throttler.Bucket(key, l.limit)
+	now := time.Now()
+	d := ratelimit.Decision{Limit: l.limit, Window: l.throttler.window}
+	if got := b.Take(cost); got == cost {
+		d.Allowed = true
+	} else {
+		b.Put(got)
+	}
+	tokens := atomic.LoadInt64(&b.tokens)
+	if !d.Allowed {
+		d.RetryAfter = b.wait(max(1, cost-tokens))
+	}
+	d.Remaining = tokens
+	d.Reset = now.Add(b.wait(l.limit - tokens))
+	return d, nil
+}
 
-// ReqThrottledHandler wraps an http.Handler with per host request throttling
-// to the specified request maxAmount, responding with 429 when throttled.
-func RequestThrottler(h http.Handler, maxAmount int64) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host, _, _ := net.SplitHostPort(r.RemoteAddr)
-		if requestThrottler.Halt(host, 1, maxAmount) {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			return
-		}
-		h.ServeHTTP(w, r)
-	})
+// Close stops refilling the buckets
+func (l *Limiter) Close() error {
+	return l.throttler.Close()
 }
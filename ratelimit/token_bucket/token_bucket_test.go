@@ -0,0 +1,29 @@
+package token_bucket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	t.Parallel()
+
+	l := New(10, time.Second) // a token every 100ms
+	defer l.Close()
+
+	if d, _ := l.Allow(context.Background(), "a", 10); !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("Expected the whole bucket to be taken. Got: %+v", d)
+	}
+	d, _ := l.Allow(context.Background(), "a", 5)
+	if d.Allowed {
+		t.Fatal("Expected an empty bucket")
+	}
+	// The wait of the bucket for the missing tokens
+	if d.RetryAfter < 400*time.Millisecond || d.RetryAfter > 500*time.Millisecond {
+		t.Fatalf("Expected a retry after 500ms at most. Got: %s", d.RetryAfter)
+	}
+	if d, _ := l.Allow(context.Background(), "b", 1); !d.Allowed || d.Remaining != 9 {
+		t.Fatalf("Expected another key to have its own bucket. Got: %+v", d)
+	}
+}
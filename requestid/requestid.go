@@ -0,0 +1,133 @@
+// Package requestid gives every request an ID, kept from the client when it's valid,
+// forwarded upstream and echoed on the response.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header holds the request ID
+const Header = "X-Request-ID"
+
+// maxLength bounds the IDs accepted from clients
+const maxLength = 128
+
+type contextKey struct{}
+
+// FromContext returns the ID of the request, empty when it went through no Handler
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Get returns the ID of r, from its context or its header
+func Get(r *http.Request) string {
+	if id := FromContext(r.Context()); id != "" {
+		return id
+	}
+	return r.Header.Get(Header)
+}
+
+// Handler sets the ID of the requests handled by h, in their context and header, and echoes
+// it on the responses. A valid ID sent by the client is kept, otherwise a ULID is generated.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !Valid(id) {
+			id = New()
+		}
+		r.Header.Set(Header, id)
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, id))
+		h.ServeHTTP(&echoWriter{ResponseWriter: w, id: id}, r)
+	})
+}
+
+// Valid tells whether id can be used as a request ID: 1 to 128 letters, digits, or - _ . :
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// crockford is the base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	ulidMutex sync.Mutex
+	lastTime  uint64
+	lastRand  [10]byte
+)
+
+// New returns a ULID: 48 bits of milliseconds since the epoch then 80 random bits, in
+// 26 Crockford base32 characters. The IDs generated within a millisecond increase, so
+// they sort in generation order.
+func New() string {
+	ulidMutex.Lock()
+	now := uint64(time.Now().UnixMilli())
+	if now <= lastTime {
+		now = lastTime
+		// Increments the random part, as a big-endian number
+		for i := len(lastRand) - 1; i >= 0; i-- {
+			lastRand[i]++
+			if lastRand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		lastTime = now
+		rand.Read(lastRand[:])
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], now<<16)
+	copy(b[6:], lastRand[:])
+	ulidMutex.Unlock()
+
+	// 128 bits in 26 characters of 5 bits, the first character holds the 3 top bits
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// echoWriter sets the request ID on the response, replacing any ID set upstream
+type echoWriter struct {
+	http.ResponseWriter
+	id          string
+	wroteHeader bool
+}
+
+func (w *echoWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.ResponseWriter.Header().Set(Header, w.id)
+		w.wroteHeader = status >= 200
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *echoWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *echoWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
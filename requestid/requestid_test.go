@@ -0,0 +1,78 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	previous := New()
+	for i := 0; i < 1000; i++ {
+		id := New()
+		assert.Len(t, id, 26)
+		assert.True(t, Valid(id))
+		assert.Greater(t, id, previous, "IDs sort in generation order")
+		previous = id
+	}
+
+	// The first 10 characters are the timestamp in milliseconds
+	var ms int64
+	for _, c := range New()[:10] {
+		ms = ms*32 + int64(strings.IndexRune(crockford, c))
+	}
+	assert.WithinDuration(t, time.Now(), time.UnixMilli(ms), time.Second)
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid("01HF3Z5X8Y9Q0R1S2T3V4W5X6Y"))
+	assert.True(t, Valid("3f2b7c1e-9d4a-4b6e-8f0a-1c2d3e4f5a6b"))
+	assert.True(t, Valid("trace:span.1_2"))
+	assert.False(t, Valid(""))
+	assert.False(t, Valid("has space"))
+	assert.False(t, Valid("line\nbreak"))
+	assert.False(t, Valid("<script>"))
+	assert.False(t, Valid(strings.Repeat("a", 129)))
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "valid", incoming: "abc-123", keep: true},
+		{name: "missing"},
+		{name: "invalid", incoming: "bad id\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream, fromContext string
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r.Header.Get(Header)
+				fromContext = FromContext(r.Context())
+				w.Header().Set(Header, "set-by-origin")
+				w.Write([]byte("ok"))
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				r.Header.Set(Header, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if tt.keep {
+				assert.Equal(t, tt.incoming, upstream)
+			} else {
+				assert.Len(t, upstream, 26)
+			}
+			assert.Equal(t, upstream, fromContext)
+			assert.Equal(t, []string{upstream}, w.Header().Values(Header), "the response echoes the request ID")
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// Package rewrite implements declarative request and response transformations:
+// header rules with templated values, path prefix and regex rewrites, Host override
+// and rewriting of the redirects sent by origins living behind a path prefix.
+package rewrite
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"proxy/utils"
+)
+
+// HeaderRules are applied in order: Remove, then Set, then Add.
+// Values are templates, see Rewriter.expand for the available variables.
+type HeaderRules struct {
+	Add    map[string]string `json:"add"`
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+// PathRule replaces the matches of a regular expression in the request path,
+// Replace may reference capture groups as in regexp.Regexp.Expand ($1, ${name}).
+type PathRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// Rules describes the transformations of a route. The path is rewritten by stripping
+// StripPrefix, then prepending AddPrefix, then applying Paths in order.
+type Rules struct {
+	StripPrefix     string      `json:"strip_prefix"`
+	AddPrefix       string      `json:"add_prefix"`
+	Paths           []PathRule  `json:"paths"`
+	Host            string      `json:"host"`
+	RequestHeaders  HeaderRules `json:"request_headers"`
+	ResponseHeaders HeaderRules `json:"response_headers"`
+	// RewriteLocation maps the Location and Content-Location headers of responses back
+	// into the client's URL space: upstream hosts are replaced by the client facing host
+	// and the prefix changes are reverted.
+	RewriteLocation bool `json:"rewrite_location"`
+}
+
+type pathRewrite struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+type Rewriter struct {
+	rules      Rules
+	paths      []pathRewrite
+	isUpstream func(host string) bool
+}
+
+// New compiles rules. isUpstream tells whether a host found in a Location header is
+// one of the origins, it may be nil when only path-absolute redirects are expected.
+func New(rules Rules, isUpstream func(host string) bool) (*Rewriter, error) {
+	rw := &Rewriter{rules: rules, isUpstream: isUpstream}
+	for _, p := range rules.Paths {
+		re, err := regexp.Compile(p.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path rule %q: %w", p.Match, err)
+		}
+		rw.paths = append(rw.paths, pathRewrite{re: re, replace: p.Replace})
+	}
+	return rw, nil
+}
+
+// Handler applies the request rules before calling h, and the response rules to what h writes
+func (rw *Rewriter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := rw.vars(r)
+
+		// the request is copied, r stays as the client sent it
+		outreq := new(http.Request)
+		*outreq = *r
+		outreq.URL = new(url.URL)
+		*outreq.URL = *r.URL
+		outreq.Header = r.Header.Clone()
+
+		if path := rw.rewritePath(r.URL.Path); path != r.URL.Path {
+			outreq.URL.Path = path
+			outreq.URL.RawPath = ""
+		}
+		if rw.rules.Host != "" {
+			outreq.Host = expand(rw.rules.Host, vars)
+		}
+		applyHeaderRules(outreq.Header, rw.rules.RequestHeaders, vars)
+
+		h.ServeHTTP(&responseWriter{ResponseWriter: w, rw: rw, r: r, vars: vars}, outreq)
+	})
+}
+
+func (rw *Rewriter) rewritePath(path string) string {
+	if strip := strings.TrimSuffix(rw.rules.StripPrefix, "/"); strip != "" {
+		if path == strip || strings.HasPrefix(path, strip+"/") {
+			path = strings.TrimPrefix(path, strip)
+		}
+	}
+	if add := strings.TrimSuffix(rw.rules.AddPrefix, "/"); add != "" {
+		path = add + path
+	}
+	for _, p := range rw.paths {
+		path = p.re.ReplaceAllString(path, p.replace)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// revertPath maps an upstream path back to the client's URL space by undoing the prefix changes.
+// Regex rewrites can't be reverted and are ignored.
+func (rw *Rewriter) revertPath(path string) string {
+	if add := strings.TrimSuffix(rw.rules.AddPrefix, "/"); add != "" {
+		if path != add && !strings.HasPrefix(path, add+"/") {
+			return path
+		}
+		path = strings.TrimPrefix(path, add)
+	}
+	if strip := strings.TrimSuffix(rw.rules.StripPrefix, "/"); strip != "" {
+		path = strip + path
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path
+}
+
+// rewriteLocation rewrites a redirect target sent by the origin for the client request r
+func (rw *Rewriter) rewriteLocation(location string, r *http.Request) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.Host != "" {
+		upstream := (rw.isUpstream != nil && rw.isUpstream(u.Host)) ||
+			(rw.rules.Host != "" && u.Host == rw.rules.Host)
+		if !upstream {
+			return location
+		}
+		u.Host = r.Host
+		if u.Scheme != "" {
+			u.Scheme = scheme(r)
+		}
+	} else if !strings.HasPrefix(u.Path, "/") {
+		// relative references resolve against the client's URL already
+		return location
+	}
+	u.Path = rw.revertPath(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+// vars returns the template variables of a request:
+//
+//	${client_ip}   client address as returned by utils.GetRemoteIP
+//	${request_id}  X-Request-ID header
+//	${host}, ${method}, ${path}, ${query}, ${scheme}  parts of the client's request
+//	${http_<name>} any request header, e.g. ${http_user_agent}
+func (rw *Rewriter) vars(r *http.Request) func(string) string {
+	return func(name string) string {
+		switch name {
+		case "client_ip":
+			return utils.GetRemoteIP(r)
+		case "request_id":
+			return r.Header.Get("X-Request-ID")
+		case "host":
+			return r.Host
+		case "method":
+			return r.Method
+		case "path":
+			return r.URL.Path
+		case "query":
+			return r.URL.RawQuery
+		case "scheme":
+			return scheme(r)
+		}
+		if field, ok := strings.CutPrefix(name, "http_"); ok {
+			return r.Header.Get(strings.ReplaceAll(field, "_", "-"))
+		}
+		return ""
+	}
+}
+
+func expand(template string, vars func(string) string) string {
+	return os.Expand(template, vars)
+}
+
+func applyHeaderRules(h http.Header, rules HeaderRules, vars func(string) string) {
+	for _, k := range rules.Remove {
+		h.Del(k)
+	}
+	for k, v := range rules.Set {
+		h.Set(k, expand(v, vars))
+	}
+	for k, v := range rules.Add {
+		h.Add(k, expand(v, vars))
+	}
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// responseWriter applies the response rules right before the header is sent
+type responseWriter struct {
+	http.ResponseWriter
+	rw      *Rewriter
+	r       *http.Request
+	vars    func(string) string
+	applied bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.applied && status >= 200 {
+		w.applied = true
+		header := w.Header()
+		applyHeaderRules(header, w.rw.rules.ResponseHeaders, w.vars)
+		if w.rw.rules.RewriteLocation {
+			for _, k := range []string{"Location", "Content-Location"} {
+				if v := header.Get(k); v != "" {
+					header.Set(k, w.rw.rewriteLocation(v, w.r))
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,106 @@
+package rewrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriter_rewritePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules Rules
+		path  string
+		want  string
+	}{
+		{name: "strip_prefix", rules: Rules{StripPrefix: "/api"}, path: "/api/get", want: "/get"},
+		{name: "strip_prefix_root", rules: Rules{StripPrefix: "/api/"}, path: "/api", want: "/"},
+		{name: "strip_prefix_no_match", rules: Rules{StripPrefix: "/api"}, path: "/apiv2/get", want: "/apiv2/get"},
+		{name: "add_prefix", rules: Rules{AddPrefix: "/v1/"}, path: "/get", want: "/v1/get"},
+		{name: "strip_and_add", rules: Rules{StripPrefix: "/api", AddPrefix: "/v2"}, path: "/api/get", want: "/v2/get"},
+		{
+			name:  "regex",
+			rules: Rules{Paths: []PathRule{{Match: `^/users/(\d+)/profile$`, Replace: "/profiles/$1"}}},
+			path:  "/users/42/profile",
+			want:  "/profiles/42",
+		},
+	}
+	for _, tt := range tests {
+		rw, err := New(tt.rules, nil)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, rw.rewritePath(tt.path), tt.name)
+	}
+}
+
+func TestRewriter_rewriteLocation(t *testing.T) {
+	isUpstream := func(host string) bool { return host == "127.0.0.1:8080" }
+	tests := []struct {
+		name     string
+		rules    Rules
+		location string
+		want     string
+	}{
+		{name: "path_absolute", rules: Rules{StripPrefix: "/api"}, location: "/login", want: "/api/login"},
+		{name: "upstream_url", rules: Rules{StripPrefix: "/api"}, location: "http://127.0.0.1:8080/login?next=%2F", want: "http://proxy.local/api/login?next=%2F"},
+		{name: "external_url", rules: Rules{StripPrefix: "/api"}, location: "https://example.com/login", want: "https://example.com/login"},
+		{name: "relative", rules: Rules{StripPrefix: "/api"}, location: "login", want: "login"},
+		{name: "add_prefix_reverted", rules: Rules{StripPrefix: "/api", AddPrefix: "/v1"}, location: "/v1/login", want: "/api/login"},
+		{name: "outside_add_prefix", rules: Rules{AddPrefix: "/v1"}, location: "/static/a.css", want: "/static/a.css"},
+		{name: "host_override", rules: Rules{Host: "origin.internal"}, location: "http://origin.internal/a", want: "http://proxy.local/a"},
+	}
+	for _, tt := range tests {
+		rw, err := New(tt.rules, isUpstream)
+		assert.NoError(t, err, tt.name)
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.local/api/get", nil)
+		assert.Equal(t, tt.want, rw.rewriteLocation(tt.location, r), tt.name)
+	}
+}
+
+func TestRewriter_Handler(t *testing.T) {
+	rw, err := New(Rules{
+		StripPrefix: "/api",
+		Host:        "origin.internal",
+		RequestHeaders: HeaderRules{
+			Set:    map[string]string{"X-Client-IP": "${client_ip}", "X-Original-Path": "${path}"},
+			Add:    map[string]string{"X-Agent": "proxy/${http_user_agent}"},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: HeaderRules{
+			Set:    map[string]string{"X-Served-By": "proxy"},
+			Remove: []string{"Server"},
+		},
+		RewriteLocation: true,
+	}, nil)
+	assert.NoError(t, err)
+
+	var got *http.Request
+	h := rw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Server", "origin")
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusFound)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "http://proxy.local/api/get", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, "/get", got.URL.Path)
+	assert.Equal(t, "origin.internal", got.Host)
+	assert.Equal(t, "10.0.0.1", got.Header.Get("X-Client-IP"))
+	assert.Equal(t, "/api/get", got.Header.Get("X-Original-Path"))
+	assert.Equal(t, "proxy/test", got.Header.Get("X-Agent"))
+	assert.Empty(t, got.Header.Get("Cookie"))
+	// the client's request is left untouched
+	assert.Equal(t, "/api/get", r.URL.Path)
+	assert.Equal(t, "session=1", r.Header.Get("Cookie"))
+
+	assert.Equal(t, "proxy", w.Header().Get("X-Served-By"))
+	assert.Empty(t, w.Header().Get("Server"))
+	assert.Equal(t, "/api/login", w.Header().Get("Location"))
+}
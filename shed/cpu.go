@@ -0,0 +1,43 @@
+package shed
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cpuInterval is the period over which the CPU use is measured
+const cpuInterval = time.Second
+
+var (
+	cpuOnce sync.Once
+	cpuLoad atomic.Uint64 // float64 bits
+)
+
+// CPU returns the signal of the CPU time used by the process over the last second, as a
+// share of the CPUs it can run on. It stays at 0 on systems without process CPU times.
+func CPU() Signal {
+	cpuOnce.Do(func() {
+		go sampleCPU()
+	})
+	return Signal{Name: "cpu", Load: func() float64 {
+		return math.Float64frombits(cpuLoad.Load())
+	}}
+}
+
+func sampleCPU() {
+	last, ok := cpuTime()
+	if !ok {
+		return
+	}
+	lastAt := time.Now()
+	for range time.Tick(cpuInterval) {
+		used, _ := cpuTime()
+		now := time.Now()
+		load := (used - last).Seconds() / now.Sub(lastAt).Seconds() / float64(runtime.GOMAXPROCS(0))
+		cpuLoad.Store(math.Float64bits(load))
+		last, lastAt = used, now
+	}
+}
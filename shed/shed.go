@@ -0,0 +1,136 @@
+// Package shed rejects requests by priority when the proxy is overloaded: the lower a
+// request's priority, the lower the load at which it's shed, which keeps the remaining
+// capacity for the higher priorities.
+package shed
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"proxy/auth"
+	"proxy/errpage"
+	"proxy/requestid"
+)
+
+// Priority is the tier of a request, from Low to Critical
+type Priority int
+
+const (
+	Low Priority = iota
+	Normal
+	High
+	Critical
+)
+
+var priorityNames = []string{"low", "normal", "high", "critical"}
+
+func (p Priority) String() string {
+	if p < Low || p > Critical {
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority returns the priority named s, case-insensitively
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return Priority(i), nil
+		}
+	}
+	return Normal, fmt.Errorf("invalid priority %q", s)
+}
+
+// DefaultThresholds are the loads from which each priority is shed. Critical requests
+// have no threshold, they're only refused by the server queues once those are full.
+var DefaultThresholds = map[Priority]float64{
+	Low:    0.5,
+	Normal: 0.75,
+	High:   0.9,
+}
+
+// Signal measures one source of pressure, Load returns 0 when idle and 1 at saturation
+type Signal struct {
+	Name string
+	Load func() float64
+}
+
+// Decision is the admission of a request
+type Decision struct {
+	Priority Priority
+	Load     float64 // the highest load of the signals
+	Signal   string  // name of the signal with the highest load
+	Admitted bool
+}
+
+// Policy classifies the requests of a route and sheds them under pressure
+type Policy struct {
+	// Priority is given to requests not classified by Subjects or Header
+	Priority Priority
+	// Header names a request header whose value is a priority name. Clients can set it
+	// themselves, it's meant to be set by a trusted front.
+	Header string
+	// Subjects sets the priority of authenticated identities, by subject
+	Subjects map[string]Priority
+	// Thresholds are the loads from which each priority is shed, DefaultThresholds when nil
+	Thresholds map[Priority]float64
+	Signals    []Signal
+	// OnDecision is called with the decision on every request
+	OnDecision func(r *http.Request, d Decision)
+}
+
+// Classify returns the priority of r: the one of its authenticated subject, else the one
+// named by its header, else the route's
+func (p *Policy) Classify(r *http.Request) Priority {
+	if id := auth.FromContext(r.Context()); id != nil {
+		if priority, ok := p.Subjects[id.Subject]; ok {
+			return priority
+		}
+	}
+	if p.Header != "" {
+		if value := r.Header.Get(p.Header); value != "" {
+			if priority, err := ParsePriority(value); err == nil {
+				return priority
+			}
+		}
+	}
+	return p.Priority
+}
+
+// Decide admits r unless the load is at or over the threshold of its priority
+func (p *Policy) Decide(r *http.Request) Decision {
+	d := Decision{Priority: p.Classify(r), Admitted: true}
+	for _, s := range p.Signals {
+		if load := s.Load(); load > d.Load {
+			d.Load, d.Signal = load, s.Name
+		}
+	}
+	thresholds := p.Thresholds
+	if thresholds == nil {
+		thresholds = DefaultThresholds
+	}
+	if threshold, ok := thresholds[d.Priority]; ok && d.Load >= threshold {
+		d.Admitted = false
+	}
+	return d
+}
+
+// Handler sheds the requests refused by policy before they're handled by h
+func Handler(h http.Handler, policy Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := policy.Decide(r)
+		if policy.OnDecision != nil {
+			policy.OnDecision(r, d)
+		}
+		if d.Admitted {
+			h.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("shed: rejected %s priority %s %s at %s load %.2f, request %s",
+			d.Priority, r.Method, r.URL.Path, d.Signal, d.Load, requestid.Get(r))
+		w.Header().Set("Retry-After", "1")
+		errpage.Write(w, r, http.StatusServiceUnavailable, "Server overloaded")
+	})
+}
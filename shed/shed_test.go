@@ -0,0 +1,87 @@
+package shed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"proxy/auth"
+)
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{Low, Normal, High, Critical} {
+		parsed, err := ParsePriority(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	p, err := ParsePriority("HIGH")
+	assert.NoError(t, err)
+	assert.Equal(t, High, p)
+	_, err = ParsePriority("urgent")
+	assert.Error(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	load := 0.0
+	var decisions []Decision
+	policy := Policy{
+		Priority: Normal,
+		Header:   "X-Priority",
+		Subjects: map[string]Priority{"checkout": Critical},
+		Signals: []Signal{
+			{Name: "queue", Load: func() float64 { return load }},
+			{Name: "cpu", Load: func() float64 { return 0.1 }},
+		},
+		OnDecision: func(_ *http.Request, d Decision) { decisions = append(decisions, d) },
+	}
+	h := auth.Handler(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), policy), auth.Policy{
+		Authenticators: []auth.Authenticator{auth.NewAPIKeys("X-API-Key", "", map[string]string{"k1": "checkout"})},
+		Optional:       true,
+	})
+
+	tests := []struct {
+		name         string
+		load         float64
+		header       string
+		apiKey       string
+		wantPriority Priority
+		wantStatus   int
+	}{
+		{name: "idle", load: 0, wantPriority: Normal, wantStatus: http.StatusOK},
+		{name: "low under threshold", load: 0.4, header: "low", wantPriority: Low, wantStatus: http.StatusOK},
+		{name: "low shed", load: 0.5, header: "low", wantPriority: Low, wantStatus: http.StatusServiceUnavailable},
+		{name: "normal kept", load: 0.6, wantPriority: Normal, wantStatus: http.StatusOK},
+		{name: "normal shed", load: 0.8, wantPriority: Normal, wantStatus: http.StatusServiceUnavailable},
+		{name: "invalid header", load: 0.8, header: "urgent", wantPriority: Normal, wantStatus: http.StatusServiceUnavailable},
+		{name: "high kept", load: 0.8, header: "high", wantPriority: High, wantStatus: http.StatusOK},
+		{name: "high shed", load: 0.95, header: "high", wantPriority: High, wantStatus: http.StatusServiceUnavailable},
+		{name: "critical never shed", load: 2, header: "critical", wantPriority: Critical, wantStatus: http.StatusOK},
+		{name: "identity over header", load: 0.95, header: "low", apiKey: "k1", wantPriority: Critical, wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			load, decisions = test.load, nil
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.header != "" {
+				r.Header.Set("X-Priority", test.header)
+			}
+			if test.apiKey != "" {
+				r.Header.Set("X-API-Key", test.apiKey)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, test.wantStatus, w.Code)
+			if assert.Len(t, decisions, 1) {
+				assert.Equal(t, test.wantPriority, decisions[0].Priority)
+				assert.Equal(t, test.wantStatus == http.StatusOK, decisions[0].Admitted)
+				assert.Equal(t, max(test.load, 0.1), decisions[0].Load)
+			}
+			if test.wantStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, "queue", decisions[0].Signal)
+				assert.Equal(t, "1", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
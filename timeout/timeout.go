@@ -0,0 +1,228 @@
+// Package timeout enforces per-request timeout policies with deadlines set through
+// http.ResponseController and cancellation of the request context, instead of the
+// server-wide ReadTimeout and WriteTimeout which cut long uploads and streams.
+package timeout
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Causes of the request context cancellation, see context.Cause
+var (
+	ErrRequestTimeout        = errors.New("request timeout")
+	ErrResponseHeaderTimeout = errors.New("upstream response header timeout")
+	ErrStreamIdleTimeout     = errors.New("stream idle timeout")
+)
+
+// Policy holds the timeouts of a route, a zero duration disables the corresponding timeout
+type Policy struct {
+	// Request is the total time allowed to serve a request, body upload included
+	Request time.Duration
+	// BodyIdle is the longest time allowed between two reads of the request body
+	BodyIdle time.Duration
+	// ResponseHeader is the time allowed to the upstream to send the response header once
+	// it got the whole request, the body upload and the wait for a server don't count
+	ResponseHeader time.Duration
+	// StreamIdle is the longest time allowed between two writes of the response body
+	StreamIdle time.Duration
+	// Streaming exempts every request from the Request timeout. Upgrades, gRPC and
+	// event-stream requests or responses are always exempt.
+	Streaming bool
+}
+
+// Handler wraps h with the policy p
+func Handler(h http.Handler, p Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+
+		rc := http.NewResponseController(w)
+		upgrade := r.Header.Get("Upgrade") != ""
+		tw := &timeoutWriter{ResponseWriter: w, rc: rc}
+
+		if p.Request > 0 && !p.Streaming && !isStreamingRequest(r) {
+			tw.deadline = time.Now().Add(p.Request)
+			tw.requestTimer = time.AfterFunc(p.Request, func() { cancel(ErrRequestTimeout) })
+			defer tw.requestTimer.Stop()
+			rc.SetWriteDeadline(tw.deadline)
+			// the connection may be reused by the next request, which must not inherit the deadline
+			defer rc.SetWriteDeadline(time.Time{})
+		}
+		if p.ResponseHeader > 0 {
+			// Armed by the transport once the request is written upstream
+			tw.headerTimer = time.AfterFunc(p.ResponseHeader, func() { cancel(ErrResponseHeaderTimeout) })
+			tw.headerTimer.Stop()
+			defer tw.headerTimer.Stop()
+			ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+				WroteRequest: func(info httptrace.WroteRequestInfo) {
+					if info.Err == nil {
+						tw.requestWritten(p.ResponseHeader)
+					}
+				},
+			})
+		}
+		if p.StreamIdle > 0 && !upgrade {
+			tw.streamIdle = p.StreamIdle
+			tw.idleTimer = time.AfterFunc(p.StreamIdle, func() { cancel(ErrStreamIdleTimeout) })
+			tw.idleTimer.Stop()
+			defer tw.idleTimer.Stop()
+		}
+
+		r = r.WithContext(ctx)
+		if p.BodyIdle > 0 && r.Body != nil && r.Body != http.NoBody {
+			r.Body = &idleReader{ReadCloser: r.Body, rc: rc, idle: p.BodyIdle, tw: tw}
+		}
+		h.ServeHTTP(tw, r)
+	})
+}
+
+// isStreamingRequest tells whether a request is expected to stay open for long
+func isStreamingRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept)); mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamingTypes are the media types of responses streamed message by message
+var streamingTypes = map[string]bool{
+	"text/event-stream":    true,
+	"application/x-ndjson": true,
+	"application/grpc":     true,
+}
+
+// IsStreamingType tells whether contentType is the one of a response streamed message by
+// message, gRPC ones with a subtype such as application/grpc+proto included
+func IsStreamingType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "application/grpc+") {
+		return true
+	}
+	return streamingTypes[mediaType]
+}
+
+// timeoutWriter stops the response header timer once the upstream answered and
+// re-arms the stream idle timer on every write
+type timeoutWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	deadline time.Time // zero when there's no total timeout
+
+	mutex        sync.Mutex
+	wroteHeader  bool
+	requestTimer *time.Timer
+	headerTimer  *time.Timer
+	headerArmed  bool
+	idleTimer    *time.Timer
+	streamIdle   time.Duration
+}
+
+func (t *timeoutWriter) WriteHeader(status int) {
+	t.mutex.Lock()
+	if !t.wroteHeader && status >= 200 {
+		t.wroteHeader = true
+		if t.headerTimer != nil {
+			t.headerTimer.Stop()
+		}
+		if t.requestTimer != nil && IsStreamingType(t.Header().Get("Content-Type")) {
+			// the total timeout doesn't apply to streams detected from the response
+			t.requestTimer.Stop()
+			t.deadline = time.Time{}
+			t.rc.SetWriteDeadline(time.Time{})
+		}
+	}
+	t.mutex.Unlock()
+	t.ResponseWriter.WriteHeader(status)
+	t.activity()
+}
+
+func (t *timeoutWriter) Write(p []byte) (int, error) {
+	if !t.headerWritten() {
+		t.WriteHeader(http.StatusOK)
+	}
+	n, err := t.ResponseWriter.Write(p)
+	t.activity()
+	return n, err
+}
+
+func (t *timeoutWriter) Flush() {
+	if !t.headerWritten() {
+		t.WriteHeader(http.StatusOK)
+	}
+	t.rc.Flush()
+	t.activity()
+}
+
+func (t *timeoutWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// requestWritten starts the response header timer when a request is first written upstream,
+// later hedged or retried copies don't restart it
+func (t *timeoutWriter) requestWritten(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.wroteHeader && !t.headerArmed {
+		t.headerArmed = true
+		t.headerTimer.Reset(d)
+	}
+}
+
+func (t *timeoutWriter) headerWritten() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.wroteHeader
+}
+
+func (t *timeoutWriter) activity() {
+	if t.idleTimer != nil && t.headerWritten() {
+		t.idleTimer.Reset(t.streamIdle)
+	}
+}
+
+// readDeadline returns the deadline the connection goes back to once the body is read
+func (t *timeoutWriter) readDeadline() time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.deadline
+}
+
+// idleReader moves the connection read deadline forward before each read of the body
+type idleReader struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	idle time.Duration
+	tw   *timeoutWriter
+	done bool
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	if i.done {
+		return i.ReadCloser.Read(p)
+	}
+	i.rc.SetReadDeadline(time.Now().Add(i.idle))
+	n, err := i.ReadCloser.Read(p)
+	if err != nil {
+		// a deadline left on the connection would make the server's background read
+		// fail and cancel the request while the response is still being sent
+		i.done = true
+		i.rc.SetReadDeadline(i.tw.readDeadline())
+	}
+	return n, err
+}
@@ -0,0 +1,193 @@
+package timeout
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// origin waits for the request context and reports its cancellation cause, or writes body
+func origin(delay time.Duration, causes chan<- error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("body"))
+			causes <- nil
+		case <-r.Context().Done():
+			causes <- context.Cause(r.Context())
+		}
+	})
+}
+
+func TestHandler_ResponseHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("body"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	target, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		assert.ErrorIs(t, context.Cause(r.Context()), ErrResponseHeaderTimeout)
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stands for the wait for a server in the queue
+		queue, _ := time.ParseDuration(r.URL.Query().Get("queue"))
+		time.Sleep(queue)
+		proxy.ServeHTTP(w, r)
+	}), Policy{ResponseHeader: 100 * time.Millisecond}))
+	defer srv.Close()
+
+	// slowBody sends its last byte after 300ms
+	slowBody := func() io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("start"))
+			time.Sleep(300 * time.Millisecond)
+			pw.Write([]byte("end"))
+			pw.Close()
+		}()
+		return pr
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		body       func() io.Reader
+		wantStatus int
+	}{
+		{name: "fast upstream", wantStatus: http.StatusOK},
+		{name: "slow upstream", query: "delay=1s", wantStatus: http.StatusGatewayTimeout},
+		{name: "slow upload", body: slowBody, wantStatus: http.StatusOK},
+		{name: "slow upload and upstream", query: "delay=1s", body: slowBody, wantStatus: http.StatusGatewayTimeout},
+		{name: "queued", query: "queue=300ms", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = http.NoBody
+			if tt.body != nil {
+				body = tt.body()
+			}
+			resp, err := http.Post(srv.URL+"/?"+tt.query, "text/plain", body)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestIsStreamingType(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"text/event-stream":                true,
+		"application/x-ndjson":             true,
+		"application/grpc":                 true,
+		"application/grpc+proto":           true,
+		"text/event-stream; charset=utf-8": true,
+		"application/json":                 false,
+		"":                                 false,
+	} {
+		assert.Equal(t, want, IsStreamingType(contentType), contentType)
+	}
+}
+
+func TestHandler_Request(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		header    http.Header
+		wantCause error
+	}{
+		{name: "timeout", policy: Policy{Request: 50 * time.Millisecond}, wantCause: ErrRequestTimeout},
+		{name: "streaming_route", policy: Policy{Request: 50 * time.Millisecond, Streaming: true}},
+		{name: "event_stream", policy: Policy{Request: 50 * time.Millisecond}, header: http.Header{"Accept": {"text/event-stream"}}},
+		{name: "grpc", policy: Policy{Request: 50 * time.Millisecond}, header: http.Header{"Content-Type": {"application/grpc"}}},
+	}
+	for _, tt := range tests {
+		causes := make(chan error, 1)
+		srv := httptest.NewServer(Handler(origin(200*time.Millisecond, causes), tt.policy))
+
+		r, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		for k, vs := range tt.header {
+			r.Header[k] = vs
+		}
+		go func() {
+			if resp, err := http.DefaultClient.Do(r); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		if tt.wantCause == nil {
+			assert.NoError(t, <-causes, tt.name)
+		} else {
+			assert.ErrorIs(t, <-causes, tt.wantCause, tt.name)
+		}
+		srv.Close()
+	}
+}
+
+func TestHandler_StreamIdle(t *testing.T) {
+	causes := make(chan error, 1)
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// a steady stream outlives the idle timeout
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+		// then the stream goes silent
+		<-r.Context().Done()
+		causes <- context.Cause(r.Context())
+	}), Policy{StreamIdle: 50 * time.Millisecond}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.ErrorIs(t, <-causes, ErrStreamIdleTimeout)
+}
+
+func TestHandler_BodyIdle(t *testing.T) {
+	readErr := make(chan error, 1)
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		readErr <- err
+	}), Policy{BodyIdle: 50 * time.Millisecond}))
+	defer srv.Close()
+
+	// a client sending the body in quick chunks is fine
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.NoError(t, <-readErr)
+
+	// a client stalling in the middle of the body is cut
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("start"))
+		time.Sleep(200 * time.Millisecond)
+		pw.Close()
+	}()
+	go http.Post(srv.URL, "text/plain", pr)
+	select {
+	case err := <-readErr:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("stalled body was not cut")
+	}
+}
@@ -3,43 +3,79 @@ package utils
 import (
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
-var lookupList = []string{"X-Forwarded-For", "RemoteAddr", "X-Real-IP"}
+// trustedProxies are the peers whose forwarding headers GetRemoteIP believes, none by default
+var trustedProxies []netip.Prefix
 
-func GetRemoteIP(r *http.Request) string {
-	realIP := r.Header.Get("X-Real-IP")
-	forwardedFor := r.Header.Get("X-Forwarded-For")
+// SetTrustedProxies sets the peers whose X-Forwarded-For and X-Real-IP headers are used
+// by GetRemoteIP. It's called at startup, before any request is served.
+func SetTrustedProxies(prefixes []netip.Prefix) {
+	trustedProxies = prefixes
+}
 
-	for _, lookup := range lookupList {
-		if lookup == "RemoteAddr" {
-			// 1. Cover the basic use cases for both ipv4 and ipv6
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				// 2. Upon error, just return the remote addr.
-				return r.RemoteAddr
-			}
-			return ip
+// TrustedProxy reports whether addr is in the prefixes set by SetTrustedProxies
+func TrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
 		}
-		if lookup == "X-Forwarded-For" && forwardedFor != "" {
-			// X-Forwarded-For is potentially a list of addresses separated with ","
-			parts := strings.Split(forwardedFor, ",")
-			for i, p := range parts {
-				parts[i] = strings.TrimSpace(p)
-			}
+	}
+	return false
+}
 
-			partIndex := len(parts) - 1
-			if partIndex < 0 {
-				partIndex = 0
-			}
+// GetRemoteIP returns the client IP of r: the address of the connection, the one of its
+// PROXY header included, or the address it forwards for when it's a trusted proxy.
+func GetRemoteIP(r *http.Request) string {
+	if addr, ok := ClientAddr(r, TrustedProxy); ok {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-			return parts[partIndex]
+// ClientAddr returns the address of the peer of r, or the one it forwards for when
+// trusts it. X-Forwarded-For is read from the right, each trusted proxy having appended
+// the address of its own peer, up to the first address that isn't trusted. X-Real-IP is
+// used when there's no X-Forwarded-For. Any client can send these headers, so they're
+// never used when the peer isn't trusted.
+func ClientAddr(r *http.Request, trusts func(netip.Addr) bool) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !trusts(addr) {
+		return addr, true
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 && r.Header.Get("X-Real-IP") != "" {
+		forwarded = []string{r.Header.Get("X-Real-IP")}
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		hopAddr, err := netip.ParseAddr(hop)
+		if err != nil {
+			return netip.Addr{}, false
 		}
-		if lookup == "X-Real-IP" && realIP != "" {
-			return realIP
+		if addr = hopAddr.Unmap(); !trusts(addr) {
+			return addr, true
 		}
 	}
-
-	return ""
+	// Only trusted proxies, the farthest is the client
+	return addr, true
 }
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRemoteIP(t *testing.T) {
+	SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/28")})
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{name: "connection", remoteAddr: "198.51.100.1:1234", want: "198.51.100.1"},
+		{name: "ipv6", remoteAddr: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{name: "ipv4-mapped", remoteAddr: "[::ffff:198.51.100.1]:1234", want: "198.51.100.1"},
+		{name: "unparsable", remoteAddr: "unknown", want: "unknown"},
+		{
+			name: "forged forwarding headers", remoteAddr: "198.51.100.1:1234",
+			header: http.Header{"X-Forwarded-For": {"10.1.1.1"}, "X-Real-Ip": {"10.1.1.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name: "trusted proxy", remoteAddr: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"10.1.1.1"}},
+			want:   "10.1.1.1",
+		},
+		{
+			name: "trusted proxies chain", remoteAddr: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"10.6.6.6, 10.1.1.1", "192.0.2.2"}},
+			want:   "10.1.1.1",
+		},
+		{
+			name: "trusted proxy real ip", remoteAddr: "192.0.2.1:1234",
+			header: http.Header{"X-Real-Ip": {"10.1.1.1"}},
+			want:   "10.1.1.1",
+		},
+		{
+			name: "trusted proxy, invalid hop", remoteAddr: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"10.1.1.1, garbage"}},
+			want:   "192.0.2.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, vs := range tt.header {
+				r.Header[k] = vs
+			}
+			assert.Equal(t, tt.want, GetRemoteIP(r))
+		})
+	}
+}
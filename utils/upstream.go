@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+)
+
+// UpstreamAddr returns the network and address a server is dialed at, and the URL its
+// requests are sent to. unix:///path/to.sock URLs name a Unix domain socket, unix:@name
+// URLs an abstract one on Linux. The requests sent over a socket are plain HTTP.
+func UpstreamAddr(u *url.URL) (network, address string, target *url.URL, err error) {
+	if u.Scheme != "unix" {
+		return "tcp", u.Host, u, nil
+	}
+	address = u.Path
+	if u.Opaque != "" {
+		address = u.Opaque
+	}
+	if address == "" {
+		return "", "", nil, errors.New("no socket path")
+	}
+	return "unix", address, &url.URL{Scheme: "http", Host: "localhost"}, nil
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamAddr(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		wantNetwork string
+		wantAddress string
+		wantTarget  string
+		wantErr     bool
+	}{
+		{name: "tcp", url: "http://127.0.0.1:8081", wantNetwork: "tcp", wantAddress: "127.0.0.1:8081", wantTarget: "http://127.0.0.1:8081"},
+		{name: "socket path", url: "unix:///run/app/http.sock", wantNetwork: "unix", wantAddress: "/run/app/http.sock", wantTarget: "http://localhost"},
+		{name: "abstract socket", url: "unix:@app", wantNetwork: "unix", wantAddress: "@app", wantTarget: "http://localhost"},
+		{name: "no path", url: "unix://", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			assert.NoError(t, err)
+			network, address, target, err := UpstreamAddr(u)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.wantNetwork, network)
+			assert.Equal(t, test.wantAddress, address)
+			assert.Equal(t, test.wantTarget, target.String())
+		})
+	}
+}